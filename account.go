@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const accountPurgeInterval = 10 * time.Minute
+
+type userExport struct {
+	Exported   int64             `json:"exported"`
+	FbId       string            `json:"fb_id"`
+	Name       string            `json:"name"`
+	Registered int64             `json:"registered"`
+	Categories []exportCategory  `json:"categories"`
+	Activities []exportActivity  `json:"activities"`
+	History    []exportHistEntry `json:"history"`
+}
+
+type exportCategory struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	ParentId int64  `json:"parent_id,omitempty"`
+	Archived int64  `json:"archived,omitempty"`
+}
+
+type exportActivity struct {
+	Id         int64          `json:"id"`
+	CategoryId int64          `json:"category_id"`
+	Name       string         `json:"name"`
+	Npom       int            `json:"npom"`
+	Created    int64          `json:"created"`
+	Tags       []string       `json:"tags,omitempty"`
+	Targets    []exportTarget `json:"targets"`
+	Archived   int64          `json:"archived,omitempty"`
+}
+
+type exportTarget struct {
+	EffectiveFrom int64     `json:"effective_from"`
+	Npom          int       `json:"npom"`
+	Schedule      *schedule `json:"schedule,omitempty"`
+}
+
+type exportHistEntry struct {
+	Id         int64 `json:"id"`
+	ActivityId int64 `json:"activity_id"`
+	Tstamp     int64 `json:"tstamp"`
+	Done       int   `json:"done"`
+}
+
+// exportUserData collects everything stored for user uid
+func exportUserData(uid uint) (exp userExport, err error) {
+	exp.Exported = unixMs(time.Now())
+	err = db.QueryRow(`SELECT fb_id, IFNULL(name, ''), IFNULL(registered, 0) FROM users WHERE id=?;`, uid).
+		Scan(&exp.FbId, &exp.Name, &exp.Registered)
+	if err != nil {
+		err = fmt.Errorf("select user: %v", err)
+		return
+	}
+
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT id, name, IFNULL(parent_id, 0), IFNULL(archived, 0) FROM categories
+WHERE user_id=? ORDER BY id;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select categories: %v", err)
+		return
+	}
+	for rows.Next() {
+		var c exportCategory
+		if err = rows.Scan(&c.Id, &c.Name, &c.ParentId, &c.Archived); err != nil {
+			rows.Close()
+			err = fmt.Errorf("scan next category: %v", err)
+			return
+		}
+		exp.Categories = append(exp.Categories, c)
+	}
+	rows.Close()
+
+	tags, err := selectActivityTags(uid)
+	if err != nil {
+		return
+	}
+	targets, err := selectTargetHistories(uid, activityFilter{})
+	if err != nil {
+		return
+	}
+	rows, err = db.Query(`SELECT A.id, A.category_id, A.name, A.npom, A.createtime, IFNULL(A.archived, 0) FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE C.user_id=? ORDER BY A.id;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select activities: %v", err)
+		return
+	}
+	for rows.Next() {
+		var a exportActivity
+		var created time.Time
+		if err = rows.Scan(&a.Id, &a.CategoryId, &a.Name, &a.Npom, &created, &a.Archived); err != nil {
+			rows.Close()
+			err = fmt.Errorf("scan next activity: %v", err)
+			return
+		}
+		a.Created = unixMs(created)
+		a.Tags = tags[a.Id]
+		for _, v := range targets[a.Id] {
+			a.Targets = append(a.Targets, exportTarget{unixMs(v.since), v.npom, v.sched})
+		}
+		exp.Activities = append(exp.Activities, a)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT id, activity_id, tstamp, done FROM history WHERE user_id=? ORDER BY id;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select history: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h exportHistEntry
+		var tstamp time.Time
+		if err = rows.Scan(&h.Id, &h.ActivityId, &tstamp, &h.Done); err != nil {
+			err = fmt.Errorf("scan next history record: %v", err)
+			return
+		}
+		h.Tstamp = unixMs(tstamp)
+		exp.History = append(exp.History, h)
+	}
+	return
+}
+
+// writeUserExport sends export of user data as a downloadable json file
+func writeUserExport(w http.ResponseWriter, exp userExport, logPrefix string) {
+	respBody, err := json.Marshal(exp)
+	if err != nil {
+		internalError(logPrefix+"encode user export", err, w)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="gtd-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func exportAccountHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+	exp, err := exportUserData(*user.Id)
+	if err != nil {
+		internalError(logPrefix+"export user data", err, w)
+		return
+	}
+	writeUserExport(w, exp, logPrefix)
+}
+
+// removeAccountHandler erases user with all data. Without grace period this happens right away and the
+// response carries the final export; otherwise erasure is scheduled and can be cancelled until then.
+func removeAccountHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	grace := time.Duration(liveConf.get().params.AccountDeletionGraceHours) * time.Hour
+	if grace > 0 {
+		deleteAfter := unixMs(time.Now().Add(grace))
+		if _, err := db.Exec(`UPDATE users SET delete_after=? WHERE id=?;`, deleteAfter, *user.Id); err != nil {
+			internalError(logPrefix+"exec schedule user removal query", err, w)
+			return
+		}
+		logI.Printf(logPrefix+"user %d scheduled for removal", *user.Id)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, fmt.Sprintf(`{"delete_after":%d,"export":%q}`, deleteAfter, apiV1Prefix+"/users/me/export"))
+		return
+	}
+
+	exp, err := exportUserData(*user.Id)
+	if err != nil {
+		internalError(logPrefix+"export user data", err, w)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+	if _, err = deleteUserData(tx, int64(*user.Id)); err != nil {
+		internalError(logPrefix+"delete user data", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit user removal", err, w)
+		return
+	}
+	logI.Printf(logPrefix+"user %d removed own account", *user.Id)
+
+	writeUserExport(w, exp, logPrefix)
+}
+
+func restoreAccountHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE users SET delete_after=NULL WHERE id=?;`, *user.Id); err != nil {
+		internalError(logPrefix+"exec cancel user removal query", err, w)
+		return
+	}
+	logI.Printf(logPrefix+"user %d cancelled account removal", *user.Id)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// runAccountPurger erases accounts whose grace period has passed
+func runAccountPurger(ctx context.Context) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := purgeScheduledAccounts(); err != nil {
+			logE.Printf("purge accounts: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeScheduledAccounts() error {
+	rows, err := db.Query(`SELECT id FROM users WHERE delete_after IS NOT NULL AND delete_after<=?;`,
+		unixMs(time.Now()))
+	if err != nil {
+		return fmt.Errorf("select accounts to purge: %v", err)
+	}
+	var uids []int64
+	for rows.Next() {
+		var uid int64
+		if err = rows.Scan(&uid); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan next row: %v", err)
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+
+	for _, uid := range uids {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin tx: %v", err)
+		}
+		if _, err = deleteUserData(tx, uid); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("delete user %d: %v", uid, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("commit removal of user %d: %v", uid, err)
+		}
+		logI.Printf("purged account of user %d after grace period", uid)
+	}
+	return nil
+}
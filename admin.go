@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+
+	userActive  = "active"
+	userPending = "pending"
+	userBlocked = "blocked"
+)
+
+const defaultInviteTTL = 7 * 24 * time.Hour
+
+// adminOnly lets only admins through to f
+func adminOnly(f handleFunc) handleFunc {
+	return func(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+		if user.Id == nil || user.role != roleAdmin {
+			forbidden(logPrefix+"admin role required", nil, w)
+			return
+		}
+		f(user, w, r, logPrefix)
+	}
+}
+
+func adminUsersListHandler(_ *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	rows, err := db.Query(`SELECT U.id, U.fb_id, IFNULL(U.name, ''), IFNULL(U.registered, 0), U.role, U.status,
+(SELECT IFNULL(max(H.tstamp), 0) FROM history H WHERE H.user_id = U.id),
+(SELECT count(*) FROM categories C WHERE C.user_id = U.id),
+(SELECT count(*) FROM activities A JOIN categories C ON A.category_id = C.id WHERE C.user_id = U.id),
+(SELECT count(*) FROM history H WHERE H.user_id = U.id)
+FROM users U ORDER BY U.id ASC;`)
+	if err != nil {
+		internalError(logPrefix+"select users list", err, w)
+		return
+	}
+	defer rows.Close()
+
+	type userInfo struct {
+		Id         int64  `json:"id"`
+		FbId       string `json:"fb_id"`
+		Name       string `json:"name"`
+		Registered int64  `json:"registered"`
+		Role       string `json:"role"`
+		Status     string `json:"status"`
+		// LastActivity is the time of the latest history record, 0 if there are none
+		LastActivity  int64 `json:"last_activity"`
+		NumCategories int   `json:"num_categories"`
+		NumActivities int   `json:"num_activities"`
+		NumHistory    int   `json:"num_history"`
+	}
+	users := []userInfo{}
+	for rows.Next() {
+		var u userInfo
+		if err = rows.Scan(&u.Id, &u.FbId, &u.Name, &u.Registered, &u.Role, &u.Status,
+			&u.LastActivity, &u.NumCategories, &u.NumActivities, &u.NumHistory); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		users = append(users, u)
+	}
+
+	respBody, err := json.Marshal(users)
+	if err != nil {
+		internalError(logPrefix+"encode users list", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// adminUpdateUserHandler approves, blocks or changes role of a user
+func adminUpdateUserHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	targetId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+	if targetId == int64(*user.Id) {
+		badRequest(logPrefix+"admins cannot change their own status or role", nil, w)
+		return
+	}
+
+	var updateUserRequest struct {
+		Status string `json:"status"`
+		Role   string `json:"role"`
+	}
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&updateUserRequest); err != nil {
+		badRequest(logPrefix+"decode update user request body", err, w)
+		return
+	}
+	switch updateUserRequest.Status {
+	case "", userActive, userBlocked:
+	default:
+		badRequest(logPrefix+"invalid status", updateUserRequest.Status, w)
+		return
+	}
+	switch updateUserRequest.Role {
+	case "", roleUser, roleAdmin:
+	default:
+		badRequest(logPrefix+"invalid role", updateUserRequest.Role, w)
+		return
+	}
+
+	logI.Printf(logPrefix+"admin %d updates user %d: status=%q role=%q", *user.Id, targetId,
+		updateUserRequest.Status, updateUserRequest.Role)
+
+	res, err := db.Exec(`UPDATE users SET status=IFNULL(NULLIF(?, ''), status), role=IFNULL(NULLIF(?, ''), role)
+WHERE id=?;`, updateUserRequest.Status, updateUserRequest.Role, targetId)
+	if err != nil {
+		internalError(logPrefix+"exec update user query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		httpError(logPrefix+"user not found", targetId, http.StatusNotFound, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminRemoveUserHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	targetId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+	if targetId == int64(*user.Id) {
+		badRequest(logPrefix+"admins cannot remove themselves", nil, w)
+		return
+	}
+
+	logI.Printf(logPrefix+"admin %d removes user %d with all data", *user.Id, targetId)
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	found, err := deleteUserData(tx, targetId)
+	if err != nil {
+		internalError(logPrefix+"delete user data", err, w)
+		return
+	}
+	if !found {
+		httpError(logPrefix+"user not found", targetId, http.StatusNotFound, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit user removal", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminStatsHandler(_ *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	var stats struct {
+		DBSizeBytes   int64 `json:"db_size_bytes"`
+		NumUsers      int   `json:"num_users"`
+		NumCategories int   `json:"num_categories"`
+		NumActivities int   `json:"num_activities"`
+		NumHistory    int   `json:"num_history"`
+	}
+	err := db.QueryRow(`SELECT (SELECT page_count FROM pragma_page_count()) * (SELECT page_size FROM pragma_page_size()),
+(SELECT count(*) FROM users), (SELECT count(*) FROM categories), (SELECT count(*) FROM activities),
+(SELECT count(*) FROM history);`).Scan(&stats.DBSizeBytes, &stats.NumUsers, &stats.NumCategories,
+		&stats.NumActivities, &stats.NumHistory)
+	if err != nil {
+		internalError(logPrefix+"select instance stats", err, w)
+		return
+	}
+
+	respBody, err := json.Marshal(stats)
+	if err != nil {
+		internalError(logPrefix+"encode instance stats", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func newInviteHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	var newInviteRequest struct {
+		TTLHours int `json:"ttl_hours"`
+	}
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&newInviteRequest); err != nil {
+		badRequest(logPrefix+"decode new invite", err, w)
+		return
+	}
+	ttl := defaultInviteTTL
+	if newInviteRequest.TTLHours > 0 {
+		ttl = time.Duration(newInviteRequest.TTLHours) * time.Hour
+	}
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		internalError(logPrefix+"generate invite code", err, w)
+		return
+	}
+	code := hex.EncodeToString(b)
+
+	now := time.Now()
+	expires := now.Add(ttl).Unix() * 1000
+	execRes, err := db.Exec(`INSERT INTO invites (code, created, expires, created_by) VALUES (?, ?, ?, ?);`,
+		code, now.Unix()*1000, expires, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec insert new invite query", err, w)
+		return
+	}
+	newId, err := execRes.LastInsertId()
+	if err != nil {
+		internalError(logPrefix+"get last insert id", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d,"code":%q,"expires":%d}`, newId, code, expires))
+}
+
+func invitesListHandler(_ *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	rows, err := db.Query(`SELECT id, code, created, expires, IFNULL(created_by, 0), IFNULL(used_by, 0),
+IFNULL(used, 0) FROM invites ORDER BY id ASC;`)
+	if err != nil {
+		internalError(logPrefix+"select invites list", err, w)
+		return
+	}
+	defer rows.Close()
+
+	type inviteInfo struct {
+		Id        int64  `json:"id"`
+		Code      string `json:"code"`
+		Created   int64  `json:"created"`
+		Expires   int64  `json:"expires"`
+		CreatedBy int64  `json:"created_by"`
+		UsedBy    int64  `json:"used_by,omitempty"`
+		Used      int64  `json:"used,omitempty"`
+	}
+	invites := []inviteInfo{}
+	for rows.Next() {
+		var inv inviteInfo
+		var created, expires time.Time
+		if err = rows.Scan(&inv.Id, &inv.Code, &created, &expires, &inv.CreatedBy, &inv.UsedBy,
+			&inv.Used); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		inv.Created = unixMs(created)
+		inv.Expires = unixMs(expires)
+		invites = append(invites, inv)
+	}
+
+	respBody, err := json.Marshal(invites)
+	if err != nil {
+		internalError(logPrefix+"encode invites list", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func removeInviteHandler(_ *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	inviteId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	if _, err = db.Exec(`DELETE FROM invites WHERE id=?;`, inviteId); err != nil {
+		internalError(logPrefix+"exec remove invite query", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// useInvite marks a valid unused invite with code as used by uid; it returns false if there is no
+// such invite. An invite stays used after its user is removed.
+func useInvite(tx *sql.Tx, code string, uid int64) (bool, error) {
+	now := time.Now().Unix() * 1000
+	res, err := tx.Exec(`UPDATE invites SET used_by=?, used=? WHERE code=? AND used IS NULL AND expires>?;`,
+		uid, now, code, now)
+	if err != nil {
+		return false, fmt.Errorf("exec use invite query: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("get rows affected: %v", err)
+	}
+	return n == 1, nil
+}
+
+// deleteUserData removes user uid with all categories, activities, tags and history; it returns false if
+// there is no such user
+func deleteUserData(tx *sql.Tx, uid int64) (bool, error) {
+	queries := []struct {
+		descr string
+		query string
+	}{
+		{"history", `DELETE FROM history WHERE user_id=?1 OR activity_id IN (SELECT A.id FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE C.user_id=?1);`},
+		{"activity tags", `DELETE FROM activity_tags WHERE tag_id IN (SELECT id FROM tags WHERE user_id=?);`},
+		{"tags", `DELETE FROM tags WHERE user_id=?;`},
+		{"targets", `DELETE FROM activity_targets WHERE activity_id IN (SELECT A.id FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE C.user_id=?);`},
+		{"reminder opt-outs", `DELETE FROM reminder_optouts WHERE user_id=?1 OR activity_id IN (SELECT A.id FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE C.user_id=?1);`},
+		{"activities", `DELETE FROM activities WHERE category_id IN (SELECT id FROM categories WHERE user_id=?);`},
+		{"memberships", `DELETE FROM category_members WHERE user_id=?1 OR category_id IN
+(SELECT id FROM categories WHERE user_id=?1);`},
+		{"share links", `DELETE FROM share_links WHERE category_id IN (SELECT id FROM categories WHERE user_id=?);`},
+		{"sent category invites", `UPDATE category_members SET invited_by=NULL WHERE invited_by=?;`},
+		{"categories", `DELETE FROM categories WHERE user_id=?;`},
+		{"reminder settings", `DELETE FROM reminder_settings WHERE user_id=?;`},
+		{"webhook deliveries", `DELETE FROM webhook_deliveries WHERE webhook_id IN
+(SELECT id FROM webhooks WHERE user_id=?);`},
+		{"webhooks", `DELETE FROM webhooks WHERE user_id=?;`},
+		{"created invites", `UPDATE invites SET created_by=NULL WHERE created_by=?;`},
+		// used stays set so that the invite cannot be redeemed again
+		{"used invites", `UPDATE invites SET used_by=NULL WHERE used_by=?;`},
+		{"private templates", `DELETE FROM templates WHERE created_by=? AND NOT published;`},
+		{"created templates", `UPDATE templates SET created_by=NULL WHERE created_by=?;`},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q.query, uid); err != nil {
+			return false, fmt.Errorf("delete %s: %v", q.descr, err)
+		}
+	}
+
+	res, err := tx.Exec(`DELETE FROM users WHERE id=?;`, uid)
+	if err != nil {
+		return false, fmt.Errorf("delete user: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("get rows affected: %v", err)
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const apiV1Prefix = "/api/v1"
+
+// handlerWrapper turns a handleFunc into the http.Handler serving it (auth check, deprecation headers, etc.)
+type handlerWrapper func(f handleFunc) http.Handler
+
+// registerAPIv1 mounts all v1 routes on r. A future v2 gets its own register function and prefix
+// so both versions can be served side by side.
+func registerAPIv1(r *mux.Router, wrap handlerWrapper) {
+	r.Handle("/users/new", wrap(newUserHandler)).Methods("POST")
+	r.Handle("/users/me", wrap(removeAccountHandler)).Methods("DELETE")
+	r.Handle("/users/me/export", wrap(exportAccountHandler)).Methods("GET")
+	r.Handle("/users/me/restore", wrap(restoreAccountHandler)).Methods("POST")
+
+	routerCats := r.PathPrefix("/categories").Subrouter()
+	routerCats.Handle("/", wrap(categoriesListHandler)).Methods("GET")
+	routerCats.Handle("/new", wrap(newCategoryHandler)).Methods("POST")
+	routerCats.Handle("/shared", wrap(sharedCategoriesHandler)).Methods("GET")
+	routerCats.Handle("/{id:[0-9]+}/clone", wrap(cloneCategoryHandler)).Methods("POST")
+	routerCats.Handle("/{id:[0-9]+}", wrap(removeCategoryHandler)).Methods("DELETE")
+	routerCats.Handle("/{id:[0-9]+}", wrap(updateCategoryHandler)).Methods("PUT")
+	routerCats.Handle("/{id:[0-9]+}/parent", wrap(moveCategoryHandler)).Methods("PUT")
+	routerCats.Handle("/{id:[0-9]+}/archive", wrap(archiveCategoryHandler)).Methods("PUT")
+	routerCats.Handle("/{id:[0-9]+}/archive", wrap(unarchiveCategoryHandler)).Methods("DELETE")
+	routerCats.Handle("/{id:[0-9]+}/members", wrap(membersListHandler)).Methods("GET")
+	routerCats.Handle("/{id:[0-9]+}/members", wrap(inviteMemberHandler)).Methods("POST")
+	routerCats.Handle("/{id:[0-9]+}/members/{uid:[0-9]+}", wrap(removeMemberHandler)).Methods("DELETE")
+	routerCats.Handle("/{id:[0-9]+}/join", wrap(joinCategoryHandler)).Methods("POST")
+	routerCats.Handle("/{id:[0-9]+}/links", wrap(shareLinksListHandler)).Methods("GET")
+	routerCats.Handle("/{id:[0-9]+}/links", wrap(newShareLinkHandler)).Methods("POST")
+	routerCats.Handle("/{id:[0-9]+}/links/{link_id:[0-9]+}", wrap(removeShareLinkHandler)).Methods("DELETE")
+
+	routerActs := r.PathPrefix("/activities").Subrouter()
+	routerActs.Handle("", wrap(activitiesListHandler)).Methods("GET").
+		Queries("cat_id", "{cat_id:[0-9]+}")
+	routerActs.Handle("", wrap(activitiesListHandler)).Methods("GET").
+		Queries("tag", "{tag}")
+	routerActs.Handle("/new", wrap(newActivityHandler)).Methods("POST")
+	routerActs.Handle("/{id:[0-9]+}", wrap(removeActivityHandler)).Methods("DELETE")
+	routerActs.Handle("/{id:[0-9]+}", wrap(updateActivityHandler)).Methods("PUT")
+	routerActs.Handle("/{id:[0-9]+}/tags", wrap(setActivityTagsHandler)).Methods("PUT")
+	routerActs.Handle("/{id:[0-9]+}/schedule", wrap(setScheduleHandler)).Methods("PUT")
+	routerActs.Handle("/{id:[0-9]+}/schedule", wrap(removeScheduleHandler)).Methods("DELETE")
+	routerActs.Handle("/{id:[0-9]+}/archive", wrap(archiveActivityHandler)).Methods("PUT")
+	routerActs.Handle("/{id:[0-9]+}/archive", wrap(unarchiveActivityHandler)).Methods("DELETE")
+	routerActs.Handle("/{id:[0-9]+}/reminder_optout", wrap(optOutRemindersHandler)).Methods("PUT")
+	routerActs.Handle("/{id:[0-9]+}/reminder_optout", wrap(optInRemindersHandler)).Methods("DELETE")
+
+	routerTmpls := r.PathPrefix("/templates").Subrouter()
+	routerTmpls.Handle("/", wrap(templatesListHandler)).Methods("GET")
+	routerTmpls.Handle("/new", wrap(newTemplateHandler)).Methods("POST")
+	routerTmpls.Handle("/{id:[0-9]+}", wrap(templateHandler)).Methods("GET")
+	routerTmpls.Handle("/{id:[0-9]+}", wrap(removeTemplateHandler)).Methods("DELETE")
+	routerTmpls.Handle("/{id:[0-9]+}/instantiate", wrap(instantiateTemplateHandler)).Methods("POST")
+	routerTmpls.Handle("/{id:[0-9]+}/publish", wrap(adminOnly(publishTemplateHandler))).Methods("PUT")
+	routerTmpls.Handle("/{id:[0-9]+}/publish", wrap(adminOnly(unpublishTemplateHandler))).Methods("DELETE")
+
+	routerTags := r.PathPrefix("/tags").Subrouter()
+	routerTags.Handle("/", wrap(tagsListHandler)).Methods("GET")
+	routerTags.Handle("/new", wrap(newTagHandler)).Methods("POST")
+	routerTags.Handle("/{id:[0-9]+}", wrap(removeTagHandler)).Methods("DELETE")
+	routerTags.Handle("/{id:[0-9]+}", wrap(updateTagHandler)).Methods("PUT")
+
+	r.Handle("/reminders/settings", wrap(reminderSettingsHandler)).Methods("GET")
+	r.Handle("/reminders/settings", wrap(updateReminderSettingsHandler)).Methods("PUT")
+
+	routerHooks := r.PathPrefix("/webhooks").Subrouter()
+	routerHooks.Handle("/", wrap(webhooksListHandler)).Methods("GET")
+	routerHooks.Handle("/new", wrap(newWebhookHandler)).Methods("POST")
+	routerHooks.Handle("/{id:[0-9]+}", wrap(removeWebhookHandler)).Methods("DELETE")
+	routerHooks.Handle("/{id:[0-9]+}/deliveries", wrap(webhookDeliveriesHandler)).Methods("GET")
+
+	r.Handle("/history", wrap(membersHistoryHandler)).Methods("GET").
+		Queries("cat_id", "{cat_id:[0-9]+}", "by_member", "true")
+	r.Handle("/history", wrap(historyHandler)).Methods("GET").
+		Queries("cat_id", "{cat_id:[0-9]+}")
+	r.Handle("/history", wrap(historyHandler)).Methods("GET").
+		Queries("tag", "{tag}")
+	r.Handle("/history/targets", wrap(historyTargetsHandler)).Methods("GET").
+		Queries("cat_id", "{cat_id:[0-9]+}")
+	r.Handle("/history/targets", wrap(historyTargetsHandler)).Methods("GET").
+		Queries("tag", "{tag}")
+	r.Handle("/history/categories", wrap(categoriesHistoryHandler)).Methods("GET")
+	r.Handle("/history/do", wrap(doHandler)).Methods("POST")
+
+	routerAdmin := r.PathPrefix("/admin").Subrouter()
+	routerAdmin.Handle("/users/", wrap(adminOnly(adminUsersListHandler))).Methods("GET")
+	routerAdmin.Handle("/users/{id:[0-9]+}", wrap(adminOnly(adminUpdateUserHandler))).Methods("PUT")
+	routerAdmin.Handle("/users/{id:[0-9]+}", wrap(adminOnly(adminRemoveUserHandler))).Methods("DELETE")
+	routerAdmin.Handle("/stats", wrap(adminOnly(adminStatsHandler))).Methods("GET")
+	routerAdmin.Handle("/invites/", wrap(adminOnly(invitesListHandler))).Methods("GET")
+	routerAdmin.Handle("/invites/new", wrap(adminOnly(newInviteHandler))).Methods("POST")
+	routerAdmin.Handle("/invites/{id:[0-9]+}", wrap(adminOnly(removeInviteHandler))).Methods("DELETE")
+}
+
+// registerLegacyAliases mounts the unversioned routes gtd served before /api/v1 appeared. The list is frozen:
+// new routes are only served under a version prefix.
+func registerLegacyAliases(r *mux.Router, wrap handlerWrapper) {
+	r.Handle("/users/new", wrap(newUserHandler)).Methods("POST")
+
+	routerCats := r.PathPrefix("/categories").Subrouter()
+	routerCats.Handle("/", wrap(categoriesListHandler)).Methods("GET")
+	routerCats.Handle("/new", wrap(newCategoryHandler)).Methods("POST")
+	routerCats.Handle("/{id:[0-9]+}", wrap(removeCategoryHandler)).Methods("DELETE")
+	routerCats.Handle("/{id:[0-9]+}", wrap(updateCategoryHandler)).Methods("PUT")
+
+	routerActs := r.PathPrefix("/activities").Subrouter()
+	routerActs.Handle("", wrap(activitiesListHandler)).Methods("GET").
+		Queries("cat_id", "{cat_id:[0-9]+}")
+	routerActs.Handle("/new", wrap(newActivityHandler)).Methods("POST")
+	routerActs.Handle("/{id:[0-9]+}", wrap(removeActivityHandler)).Methods("DELETE")
+	routerActs.Handle("/{id:[0-9]+}", wrap(updateActivityHandler)).Methods("PUT")
+
+	r.Handle("/history", wrap(historyHandler)).Methods("GET").
+		Queries("cat_id", "{cat_id:[0-9]+}")
+	r.Handle("/history/do", wrap(doHandler)).Methods("POST")
+}
+
+// deprecatedAlias wraps handlers served on legacy unversioned paths so that clients are pointed to
+// the same route under successorPrefix. The warning is logged once per route so that polling clients
+// don't flood the log.
+func deprecatedAlias(wrap handlerWrapper, successorPrefix string) handlerWrapper {
+	return func(f handleFunc) http.Handler {
+		h := wrap(f)
+		var warnOnce sync.Once
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			warnOnce.Do(func() {
+				logW.Printf(requestLogPrefix(r)+"deprecated unversioned path; use %s prefix", successorPrefix)
+			})
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successorPrefix+r.URL.RequestURI()+`>; rel="successor-version"`)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Archived activities and categories are hidden from lists but keep their history, which still counts in
+// stats and exports. Archived category hides its whole subtree.
+
+func archiveActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setArchived(user, w, r, logPrefix, "activities", true)
+}
+
+func unarchiveActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setArchived(user, w, r, logPrefix, "activities", false)
+}
+
+func archiveCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setArchived(user, w, r, logPrefix, "categories", true)
+}
+
+func unarchiveCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setArchived(user, w, r, logPrefix, "categories", false)
+}
+
+// setArchived archives or restores user's row of table (activities or categories) with id from url
+func setArchived(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix, table string, archive bool) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	ownedBy := activityOwnedBy
+	if table == "categories" {
+		ownedBy = categoryOwnedBy
+	}
+	owned, err := ownedBy(id, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"not found", id, http.StatusNotFound, w)
+		return
+	}
+
+	var archived interface{}
+	if archive {
+		archived = time.Now().Unix() * 1000
+	}
+	logD.Printf(logPrefix+"setting archived of %s %d to %v", table, id, archived)
+
+	// keep the original archive time if archived twice
+	if _, err = db.Exec(`UPDATE `+table+` SET archived=? WHERE id=? AND (? IS NULL OR archived IS NULL);`,
+		archived, id, archived); err != nil {
+		internalError(logPrefix+fmt.Sprintf("exec update archived %s query", table), err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseIncludeArchived reads include_archived query param, false by default
+func parseIncludeArchived(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("include_archived")
+	if len(s) == 0 {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid include_archived query param: %v", err)
+	}
+	return include, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+const (
+	indexTemplatePath = "html/index.html"
+	boardTemplatePath = "html/board.html"
+)
+
+// assets serves static files and the index page either from the binary or, for development,
+// from an override directory on disk which is re-read on every request. Files missing from the override
+// directory, e.g. a stale copy left by an older package, are served from the binary.
+type assets struct {
+	fsys     fs.FS
+	override bool
+	index    *template.Template
+	board    *template.Template
+	etags    map[string]string
+}
+
+func newAssets(overrideDir string) (*assets, error) {
+	a := &assets{}
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		return nil, fmt.Errorf("open embedded static dir: %v", err)
+	}
+	a.fsys = sub
+	if len(overrideDir) > 0 {
+		if info, err := os.Stat(overrideDir); err != nil || !info.IsDir() {
+			logW.Printf("static_path %s is not a directory; serving embedded static files", overrideDir)
+		} else {
+			logW.Printf("serving static files from %s instead of embedded ones", overrideDir)
+			dir := os.DirFS(overrideDir)
+			for _, path := range []string{indexTemplatePath, boardTemplatePath} {
+				if _, err := fs.Stat(dir, path); err != nil {
+					logW.Printf("%s not found in static_path %s; using embedded one", path, overrideDir)
+				}
+			}
+			a.fsys = overlayFS{dir, sub}
+			a.override = true
+		}
+	}
+
+	if a.index, err = a.parseTemplate(indexTemplatePath); err != nil {
+		return nil, err
+	}
+	if a.board, err = a.parseTemplate(boardTemplatePath); err != nil {
+		return nil, err
+	}
+
+	if !a.override {
+		if a.etags, err = computeETags(a.fsys); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// overlayFS serves files of top and falls back to bottom for the ones top doesn't have
+type overlayFS struct {
+	top, bottom fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.bottom.Open(name)
+	}
+	return f, err
+}
+
+func (a *assets) parseTemplate(path string) (*template.Template, error) {
+	t, err := template.ParseFS(a.fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("parse template file %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// computeETags hashes every file in fsys; embedded content never changes while the process runs
+func computeETags(fsys fs.FS) (map[string]string, error) {
+	etags := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		etags[path] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("compute etags for static files: %v", err)
+	}
+	return etags, nil
+}
+
+// staticHandler serves files relative to the static root; it is expected to be mounted with the url
+// prefix stripped
+func (a *assets) staticHandler() http.Handler {
+	fileServer := http.FileServer(http.FS(a.fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.override {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else if etag, found := a.etags[strings.TrimPrefix(r.URL.Path, "/")]; found {
+			// http.FileServer answers If-None-Match with 304 once ETag is set
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+func (a *assets) serveIndex(w http.ResponseWriter, _ *http.Request) {
+	a.servePage(w, a.index, indexTemplatePath, nil)
+}
+
+// servePage renders page template t parsed from path with data
+func (a *assets) servePage(w http.ResponseWriter, t *template.Template, path string, data interface{}) {
+	if a.override {
+		var err error
+		if t, err = a.parseTemplate(path); err != nil {
+			internalError("reload page template", err, w)
+			return
+		}
+	}
+
+	var page bytes.Buffer
+	if err := t.Execute(&page, data); err != nil {
+		internalError("execute page template", err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	page.WriteTo(w)
+}
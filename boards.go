@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Share links give read-only access to the week board of a category, i.e. its history and targets, to
+// anyone knowing the link token. No authentication is required, so the token is the only secret.
+
+type shareLink struct {
+	Id      int64  `json:"id"`
+	Token   string `json:"token"`
+	Created int64  `json:"created"`
+	// Expires is 0 for links that never expire
+	Expires   int64 `json:"expires,omitempty"`
+	HideNames bool  `json:"hide_names"`
+}
+
+// board is the week history of a category as shown by share links
+type board struct {
+	Category   string          `json:"category"`
+	WeekStart  int64           `json:"week_start"`
+	Days       [7]string       `json:"-"`
+	Activities []boardActivity `json:"activities"`
+}
+
+type boardActivity struct {
+	Name   string     `json:"name"`
+	Done   [7]int     `json:"done"`
+	Target histTarget `json:"target"`
+}
+
+func shareLinksListHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	owned, err := categoryOwnedBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, token, created, IFNULL(expires, 0), hide_names FROM share_links
+WHERE category_id=? ORDER BY id ASC;`, catId)
+	if err != nil {
+		internalError(logPrefix+"select share links", err, w)
+		return
+	}
+	defer rows.Close()
+
+	links := []shareLink{}
+	for rows.Next() {
+		var l shareLink
+		var created time.Time
+		if err = rows.Scan(&l.Id, &l.Token, &created, &l.Expires, &l.HideNames); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		l.Created = unixMs(created)
+		links = append(links, l)
+	}
+	if err = rows.Err(); err != nil {
+		internalError(logPrefix+"read share link rows", err, w)
+		return
+	}
+
+	respBody, err := json.Marshal(links)
+	if err != nil {
+		internalError(logPrefix+"encode share links", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func newShareLinkHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var newLinkRequest struct {
+		// TTLHours is how long link stays valid; 0 means forever
+		TTLHours  int  `json:"ttl_hours"`
+		HideNames bool `json:"hide_names"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&newLinkRequest); err != nil {
+		badRequest(logPrefix+"decode new share link", err, w)
+		return
+	}
+	if newLinkRequest.TTLHours < 0 {
+		badRequest(logPrefix+"negative ttl_hours", newLinkRequest.TTLHours, w)
+		return
+	}
+
+	owned, err := categoryOwnedBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		internalError(logPrefix+"generate share link token", err, w)
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now()
+	var expires int64
+	if newLinkRequest.TTLHours > 0 {
+		expires = now.Add(time.Duration(newLinkRequest.TTLHours)*time.Hour).Unix() * 1000
+	}
+	execRes, err := db.Exec(`INSERT INTO share_links (token, category_id, created, created_by, expires, hide_names)
+VALUES (?, ?, ?, ?, NULLIF(?, 0), ?);`, token, catId, now.Unix()*1000, *user.Id, expires, newLinkRequest.HideNames)
+	if err != nil {
+		internalError(logPrefix+"exec insert new share link query", err, w)
+		return
+	}
+	newId, err := execRes.LastInsertId()
+	if err != nil {
+		internalError(logPrefix+"get last insert id", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d,"token":%q,"expires":%d}`, newId, token, expires))
+}
+
+// removeShareLinkHandler revokes share link; its token stops working immediately
+func removeShareLinkHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+	linkId, err := strconv.ParseInt(mux.Vars(r)["link_id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	owned, err := categoryOwnedBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"revoking share link %d of category %d", linkId, catId)
+
+	res, err := db.Exec(`DELETE FROM share_links WHERE id=? AND category_id=?;`, linkId, catId)
+	if err != nil {
+		internalError(logPrefix+"exec remove share link query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"share link not found", linkId, http.StatusNotFound, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// boardHandler serves the board of share link token without authentication
+func boardHandler(w http.ResponseWriter, r *http.Request) {
+	logPrefix := requestLogPrefix(r)
+	b, err := selectBoard(mux.Vars(r)["token"])
+	if err != nil {
+		internalError(logPrefix+"select board", err, w)
+		return
+	}
+	if b == nil {
+		httpError(logPrefix+"board not found", "no such link or it has expired", http.StatusNotFound, w)
+		return
+	}
+
+	respBody, err := json.Marshal(b)
+	if err != nil {
+		internalError(logPrefix+"encode board", err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// boardPageHandler serves the board of share link token as html page without authentication
+func boardPageHandler(a *assets) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logPrefix := requestLogPrefix(r)
+		b, err := selectBoard(mux.Vars(r)["token"])
+		if err != nil {
+			internalError(logPrefix+"select board", err, w)
+			return
+		}
+		if b == nil {
+			httpError(logPrefix+"board not found", "no such link or it has expired", http.StatusNotFound, w)
+			return
+		}
+		a.servePage(w, a.board, boardTemplatePath, b)
+	}
+}
+
+// selectBoard returns board of category share link token gives access to or nil if the link doesn't exist
+// or has expired. Archived activities are left out.
+func selectBoard(token string) (*board, error) {
+	var catId int64
+	var ownerId uint
+	var hideNames bool
+	b := &board{}
+	err := db.QueryRow(`SELECT C.id, C.user_id, C.name, L.hide_names FROM share_links L
+JOIN categories C ON L.category_id = C.id WHERE L.token=? AND (L.expires IS NULL OR L.expires>?);`,
+		token, time.Now().Unix()*1000).Scan(&catId, &ownerId, &b.Category, &hideNames)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select share link: %v", err)
+	}
+
+	filter := activityFilter{catId: catId, subcats: true, skipArchived: true}
+	hist, err := selectWeekHist(ownerId, filter)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := selectTargetHistories(ownerId, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	weekStart := histWeekStart()
+	b.WeekStart = unixMs(weekStart)
+	b.Days = weekdays(time.Now())
+	b.Activities = []boardActivity{}
+
+	where, args := filter.where(ownerId)
+	rows, err := db.Query(`SELECT A.id, A.name FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE `+where+`
+ORDER BY vorder ASC;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select activities: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var actId int64
+		var ba boardActivity
+		if err = rows.Scan(&actId, &ba.Name); err != nil {
+			return nil, fmt.Errorf("scan next row: %v", err)
+		}
+		if hideNames {
+			ba.Name = fmt.Sprintf("Activity %d", len(b.Activities)+1)
+		}
+		ba.Done = hist[actId]
+		ba.Target = targets[actId].hist(weekStart)
+		b.Activities = append(b.Activities, ba)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read activity rows: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const cliUsage = `usage: gtd [flags]                 run the server
+       gtd <command> [args]         talk to a running server
+
+commands:
+  login -server URL -token TOKEN    save API credentials
+  categories                        list categories
+  activities [-cat NAME]            list activities with today's progress
+  do [-n N] ACTIVITY                log N pomodoros (default 1) for activity
+  week [-cat NAME]                  show weekly history table
+`
+
+type cliConfigParams struct {
+	Server string `toml:"server"`
+	Token  string `toml:"token"`
+}
+
+type cliConfigImpl struct {
+	params cliConfigParams
+}
+
+func (c *cliConfigImpl) Params() interface{} {
+	return &c.params
+}
+
+func (c *cliConfigImpl) Validate() error {
+	logPrefix := "parsing cli config: "
+	if len(c.params.Server) == 0 {
+		return fmt.Errorf(logPrefix + "server is not set; run 'gtd login'")
+	}
+	if len(c.params.Token) == 0 {
+		return fmt.Errorf(logPrefix + "token is not set; run 'gtd login'")
+	}
+	return nil
+}
+
+func cliConfigPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); len(dir) > 0 {
+		return filepath.Join(dir, "gtd", "cli.toml")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "gtd", "cli.toml")
+}
+
+func saveCliConfig(path string, c *cliConfigImpl) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create config dir: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("open config file: %v", err)
+	}
+	defer f.Close()
+	if err = toml.NewEncoder(f).Encode(c.params); err != nil {
+		return fmt.Errorf("encode config: %v", err)
+	}
+	return nil
+}
+
+type apiClient struct {
+	server string
+	token  string
+	httpc  *http.Client
+}
+
+func newApiClient(c *cliConfigImpl) *apiClient {
+	return &apiClient{
+		server: strings.TrimRight(c.params.Server, "/") + apiV1Prefix,
+		token:  c.params.Token,
+		httpc:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call sends reqBody (if not nil) as json and decodes response into respBody (if not nil)
+func (c *apiClient) call(method, path string, reqBody, respBody interface{}) error {
+	var body bytes.Buffer
+	if reqBody != nil {
+		if err := json.NewEncoder(&body).Encode(reqBody); err != nil {
+			return fmt.Errorf("encode request: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, c.server+path, &body)
+	if err != nil {
+		return fmt.Errorf("prepare %s %s request: %v", method, path, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return fmt.Errorf("process %s %s request: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if respBody != nil {
+		if err = json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+			return fmt.Errorf("decode %s %s response: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+type cliCategory struct {
+	Id       int64         `json:"id"`
+	Name     string        `json:"name"`
+	Children []cliCategory `json:"children"`
+	// depth is the number of ancestors
+	depth int
+}
+
+// categories returns all categories flattened in depth-first order
+func (c *apiClient) categories() (cats []cliCategory, err error) {
+	var roots []cliCategory
+	if err = c.call("GET", "/categories/", nil, &roots); err != nil {
+		return
+	}
+	var flatten func(nodes []cliCategory, depth int)
+	flatten = func(nodes []cliCategory, depth int) {
+		for _, cat := range nodes {
+			cat.depth = depth
+			cats = append(cats, cat)
+			flatten(cat.Children, depth+1)
+		}
+	}
+	flatten(roots, 0)
+	return
+}
+
+func (c *apiClient) activities(catId int64) (acts []Activity, err error) {
+	var resp struct {
+		Activities []Activity `json:"activities"`
+	}
+	err = c.call("GET", "/activities?cat_id="+strconv.FormatInt(catId, 10), nil, &resp)
+	acts = resp.Activities
+	return
+}
+
+func (c *apiClient) weekHist(catId int64) (hist map[int64][7]int, err error) {
+	err = c.call("GET", "/history?cat_id="+strconv.FormatInt(catId, 10), nil, &hist)
+	return
+}
+
+type cliTarget struct {
+	Days    [7]int `json:"days"`
+	PerWeek int    `json:"per_week"`
+}
+
+func (c *apiClient) weekTargets(catId int64) (targets map[int64]cliTarget, err error) {
+	err = c.call("GET", "/history/targets?cat_id="+strconv.FormatInt(catId, 10), nil, &targets)
+	return
+}
+
+// selectCategories returns all categories or only the one named catName if it is not empty
+func (c *apiClient) selectCategories(catName string) ([]cliCategory, error) {
+	cats, err := c.categories()
+	if err != nil {
+		return nil, err
+	}
+	if len(catName) == 0 {
+		return cats, nil
+	}
+	for _, cat := range cats {
+		if strings.EqualFold(cat.Name, catName) {
+			return []cliCategory{cat}, nil
+		}
+	}
+	return nil, fmt.Errorf("no category named %q", catName)
+}
+
+// runClient executes cli command described by args and returns process exit code
+func runClient(args []string) int {
+	cmd, args := args[0], args[1:]
+	if cmd == "help" {
+		fmt.Print(cliUsage)
+		return 0
+	}
+	if cmd == "login" {
+		if err := cliLogin(args); err != nil {
+			fmt.Fprintf(os.Stderr, "gtd login: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	run, found := map[string]func(c *apiClient, args []string) error{
+		"categories": cliCategories,
+		"activities": cliActivities,
+		"do":         cliDo,
+		"week":       cliWeek,
+	}[cmd]
+	if !found {
+		fmt.Fprintf(os.Stderr, "gtd: unknown command %q\n\n%s", cmd, cliUsage)
+		return 2
+	}
+
+	var conf cliConfigImpl
+	if err := InitConfig(cliConfigPath(), &conf); err != nil {
+		fmt.Fprintf(os.Stderr, "gtd %s: init config: %v\n", cmd, err)
+		return 1
+	}
+	if err := run(newApiClient(&conf), args); err != nil {
+		fmt.Fprintf(os.Stderr, "gtd %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+func cliLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	server := fs.String("server", "", "gtd server url, e.g. https://gtd.example.com")
+	token := fs.String("token", "", "api bearer token")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var conf cliConfigImpl
+	conf.params = cliConfigParams{Server: *server, Token: *token}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	// make sure credentials work before saving them
+	if _, err := newApiClient(&conf).categories(); err != nil {
+		return fmt.Errorf("check credentials: %v", err)
+	}
+
+	path := cliConfigPath()
+	if err := saveCliConfig(path, &conf); err != nil {
+		return err
+	}
+	fmt.Printf("credentials saved to %s\n", path)
+	return nil
+}
+
+func cliCategories(c *apiClient, _ []string) error {
+	cats, err := c.categories()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME")
+	for _, cat := range cats {
+		fmt.Fprintf(tw, "%d\t%s%s\n", cat.Id, strings.Repeat("  ", cat.depth), cat.Name)
+	}
+	return tw.Flush()
+}
+
+func cliActivities(c *apiClient, args []string) error {
+	fs := flag.NewFlagSet("activities", flag.ContinueOnError)
+	catName := fs.String("cat", "", "show only this category")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cats, err := c.selectCategories(*catName)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CATEGORY\tID\tACTIVITY\tTODAY")
+	for _, cat := range cats {
+		acts, err := c.activities(cat.Id)
+		if err != nil {
+			return err
+		}
+		hist, err := c.weekHist(cat.Id)
+		if err != nil {
+			return err
+		}
+		targets, err := c.weekTargets(cat.Id)
+		if err != nil {
+			return err
+		}
+		for _, a := range acts {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d/%d\n", cat.Name, a.Id, a.Name, hist[a.Id][6], targets[a.Id].Days[6])
+		}
+	}
+	return tw.Flush()
+}
+
+func cliDo(c *apiClient, args []string) error {
+	fs := flag.NewFlagSet("do", flag.ContinueOnError)
+	n := fs.Int("n", 1, "number of pomodoros done")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one activity name")
+	}
+	actName := fs.Arg(0)
+
+	cats, err := c.categories()
+	if err != nil {
+		return err
+	}
+	var found []Activity
+	for _, cat := range cats {
+		acts, err := c.activities(cat.Id)
+		if err != nil {
+			return err
+		}
+		for _, a := range acts {
+			if strings.EqualFold(a.Name, actName) {
+				found = append(found, a)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no activity named %q", actName)
+	}
+	if len(found) > 1 {
+		return fmt.Errorf("%d activities named %q", len(found), actName)
+	}
+
+	doRequest := struct {
+		ActivityId int64 `json:"activity"`
+		DoneVal    int   `json:"done_value"`
+	}{found[0].Id, *n}
+	var doResponse struct {
+		NewValue int `json:"new_value"`
+		Left     int `json:"left"`
+	}
+	if err = c.call("POST", "/history/do", doRequest, &doResponse); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d done today, %d left\n", found[0].Name, doResponse.NewValue, doResponse.Left)
+	return nil
+}
+
+func cliWeek(c *apiClient, args []string) error {
+	fs := flag.NewFlagSet("week", flag.ContinueOnError)
+	catName := fs.String("cat", "", "show only this category")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cats, err := c.selectCategories(*catName)
+	if err != nil {
+		return err
+	}
+	days := weekdays(time.Now())
+	// index of this week's Monday among days
+	firstDayOfWeek := 6 - (int(time.Now().Weekday())+6)%7
+	for i, cat := range cats {
+		acts, err := c.activities(cat.Id)
+		if err != nil {
+			return err
+		}
+		hist, err := c.weekHist(cat.Id)
+		if err != nil {
+			return err
+		}
+		targets, err := c.weekTargets(cat.Id)
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("== %s ==\n", cat.Name)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprint(tw, "\t")
+		for _, d := range days {
+			fmt.Fprintf(tw, "%s\t", strings.Replace(d, "\n", " ", 1))
+		}
+		fmt.Fprintln(tw)
+		for _, a := range acts {
+			t := targets[a.Id]
+			fmt.Fprintf(tw, "%s\t", a.Name)
+			weekDone := 0
+			for d, done := range hist[a.Id] {
+				fmt.Fprintf(tw, "%d/%d\t", done, t.Days[d])
+				if d >= firstDayOfWeek {
+					weekDone += done
+				}
+			}
+			if t.PerWeek != 0 {
+				fmt.Fprintf(tw, "%d/%d this week\t", weekDone, t.PerWeek)
+			}
+			fmt.Fprintln(tw)
+		}
+		if err = tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -22,16 +28,261 @@ func InitConfig(path string, c Config) error {
 	return nil
 }
 
+// Sources of config param values, from lowest to highest priority
+const (
+	configSourceDefault = "default"
+	configSourceFile    = "file"
+	configSourceEnv     = "env"
+	configSourceFlag    = "flag"
+)
+
+const configEnvPrefix = "GTD_"
+
+// ConfigLayers describes where params come from on top of defaults already set in Config
+type ConfigLayers struct {
+	// Path of toml file; empty means no file
+	Path string
+	// Env is a list of KEY=value pairs like os.Environ() returns
+	Env []string
+	// Flags maps toml keys to raw values given on command line
+	Flags map[string]string
+}
+
+// InitLayeredConfig fills c.Params() from toml file, GTD_* environment variables and flags (each
+// layer overriding the previous one), validates it and returns the source of every param value
+func InitLayeredConfig(c Config, layers ConfigLayers) (sources map[string]string, err error) {
+	params := reflect.ValueOf(c.Params()).Elem()
+	sources = make(map[string]string)
+	for i := 0; i < params.NumField(); i++ {
+		sources[params.Type().Field(i).Tag.Get("toml")] = configSourceDefault
+	}
+
+	if len(layers.Path) > 0 {
+		md, err := toml.DecodeFile(layers.Path, c.Params())
+		if err != nil {
+			return nil, err
+		}
+		for key := range sources {
+			if md.IsDefined(key) {
+				sources[key] = configSourceFile
+			}
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range layers.Env {
+		if idx := strings.IndexByte(kv, '='); idx > 0 {
+			env[kv[:idx]] = kv[idx+1:]
+		}
+	}
+
+	for i := 0; i < params.NumField(); i++ {
+		key := params.Type().Field(i).Tag.Get("toml")
+		if raw, found := env[configEnvVar(key)]; found {
+			if err = setConfigValue(params.Field(i), raw); err != nil {
+				return nil, fmt.Errorf("parse %s: %v", configEnvVar(key), err)
+			}
+			sources[key] = configSourceEnv
+		}
+		if raw, found := layers.Flags[key]; found {
+			if err = setConfigValue(params.Field(i), raw); err != nil {
+				return nil, fmt.Errorf("parse -%s: %v", configFlagName(key), err)
+			}
+			sources[key] = configSourceFlag
+		}
+	}
+
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+func configEnvVar(key string) string {
+	return configEnvPrefix + strings.ToUpper(key)
+}
+
+func configFlagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// setConfigValue parses raw into param v; lists are comma separated
+func setConfigValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported param type %v", v.Type())
+	}
+	return nil
+}
+
+type configFlag struct {
+	key    string
+	values map[string]string
+}
+
+func (f configFlag) String() string {
+	return ""
+}
+
+func (f configFlag) Set(raw string) error {
+	f.values[f.key] = raw
+	return nil
+}
+
+// registerConfigFlags adds an overriding flag for every param of c to fs; after fs is parsed the
+// returned map holds raw values of flags that were set
+func registerConfigFlags(fs *flag.FlagSet, c Config) map[string]string {
+	values := make(map[string]string)
+	params := reflect.ValueOf(c.Params()).Elem()
+	for i := 0; i < params.NumField(); i++ {
+		key := params.Type().Field(i).Tag.Get("toml")
+		fs.Var(configFlag{key, values}, configFlagName(key), fmt.Sprintf("overrides %s config param", key))
+	}
+	return values
+}
+
+// printConfig writes effective params of c in toml syntax noting where each value came from
+func printConfig(c Config, sources map[string]string) {
+	params := reflect.ValueOf(c.Params()).Elem()
+	var lines []string
+	for i := 0; i < params.NumField(); i++ {
+		field := params.Type().Field(i)
+		key := field.Tag.Get("toml")
+		lines = append(lines, fmt.Sprintf("%s = %s  # %s", key, configValueTOML(field, params.Field(i)), sources[key]))
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(os.Stdout, strings.Join(lines, "\n"))
+}
+
+func configValueTOML(field reflect.StructField, v reflect.Value) string {
+	if field.Tag.Get("secret") == "true" && !reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+		return `"***"`
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Slice:
+		var items []string
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, strconv.Quote(fmt.Sprint(v.Index(i).Interface())))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v.Interface())
+}
+
 type configParams struct {
 	ListenPort    int      `toml:"listen_port"`
-	AllowedFbUids []string `toml:"allowed_fb_uids"`
+	AllowedFbUids []string `toml:"allowed_fb_uids" reload:"true"`
+	AdminFbUids   []string `toml:"admin_fb_uids" reload:"true"`
 	DBPath        string   `toml:"db_path"`
 	StaticPath    string   `toml:"static_path"`
+
+	ReadTimeoutSec     int `toml:"read_timeout_sec"`
+	WriteTimeoutSec    int `toml:"write_timeout_sec"`
+	IdleTimeoutSec     int `toml:"idle_timeout_sec"`
+	ShutdownTimeoutSec int `toml:"shutdown_timeout_sec"`
+
+	TLSCertPath      string `toml:"tls_cert_path"`
+	TLSKeyPath       string `toml:"tls_key_path"`
+	HTTPRedirectPort int    `toml:"http_redirect_port"`
+	HSTSMaxAgeSec    int    `toml:"hsts_max_age_sec"`
+
+	MetricsUser     string `toml:"metrics_user" reload:"true"`
+	MetricsPassword string `toml:"metrics_password" reload:"true" secret:"true"`
+
+	ReadyChecks          []string `toml:"ready_checks"`
+	AuthProviderCacheSec int      `toml:"auth_provider_cache_sec"`
+
+	ConfigWatchSec int `toml:"config_watch_sec"`
+
+	OpenRegistration bool `toml:"open_registration" reload:"true"`
+
+	AccountDeletionGraceHours int `toml:"account_deletion_grace_hours" reload:"true"`
+
+	// request limits per minute; 0 disables the limit
+	RateLimitIPPerMin    int `toml:"rate_limit_ip_per_min" reload:"true"`
+	RateLimitReadPerMin  int `toml:"rate_limit_read_per_min" reload:"true"`
+	RateLimitWritePerMin int `toml:"rate_limit_write_per_min" reload:"true"`
+	RateLimitDoPerMin    int `toml:"rate_limit_do_per_min" reload:"true"`
+	// RateLimitTokenPerMin applies per bearer token before it is checked with auth provider
+	RateLimitTokenPerMin int  `toml:"rate_limit_token_per_min" reload:"true"`
+	TrustProxyHeaders    bool `toml:"trust_proxy_headers" reload:"true"`
+
+	// origins other than our own that may call api from browsers; "*" allows any
+	CORSAllowedOrigins []string `toml:"cors_allowed_origins" reload:"true"`
+	CORSAllowedMethods []string `toml:"cors_allowed_methods" reload:"true"`
+	CORSAllowedHeaders []string `toml:"cors_allowed_headers" reload:"true"`
+	CORSMaxAgeSec      int      `toml:"cors_max_age_sec" reload:"true"`
+
+	// a webhook delivery is given up after so many failed attempts
+	WebhookMaxAttempts int `toml:"webhook_max_attempts" reload:"true"`
+	WebhookTimeoutSec  int `toml:"webhook_timeout_sec" reload:"true"`
+	// loopback, link-local and private addresses are off limits for webhooks except for these networks,
+	// e.g. ["127.0.0.1/32"] to try webhooks with a local receiver
+	WebhookAllowedNets []string `toml:"webhook_allowed_nets" reload:"true"`
+
+	// smtp server for email reminders as host:port; email notifier is unavailable without it
+	SMTPAddr     string `toml:"smtp_addr" reload:"true"`
+	SMTPFrom     string `toml:"smtp_from" reload:"true"`
+	SMTPUser     string `toml:"smtp_user" reload:"true"`
+	SMTPPassword string `toml:"smtp_password" reload:"true" secret:"true"`
 }
 
 type configImpl struct {
-	params      configParams
-	defaultPath string
+	params configParams
+}
+
+// newConfig returns config filled with defaults for optional params
+func newConfig() *configImpl {
+	return &configImpl{
+		params: configParams{
+			ReadTimeoutSec:     10,
+			WriteTimeoutSec:    30,
+			IdleTimeoutSec:     120,
+			ShutdownTimeoutSec: 15,
+			HSTSMaxAgeSec:      180 * 24 * 3600,
+
+			// a copy, as decoding ready_checks reuses the backing array of the default
+			ReadyChecks:          append([]string(nil), knownHealthChecks...),
+			AuthProviderCacheSec: 300,
+
+			RateLimitIPPerMin:    600,
+			RateLimitReadPerMin:  300,
+			RateLimitWritePerMin: 60,
+			RateLimitDoPerMin:    30,
+			RateLimitTokenPerMin: 600,
+
+			CORSAllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			CORSAllowedHeaders: []string{"Authorization", "Content-Type", requestIdHeader},
+			CORSMaxAgeSec:      600,
+
+			WebhookMaxAttempts: 8,
+			WebhookTimeoutSec:  10,
+		},
+	}
 }
 
 func (c *configImpl) Params() interface{} {
@@ -43,14 +294,67 @@ func (c *configImpl) Validate() error {
 	if c.params.ListenPort == 0 {
 		return fmt.Errorf(logPrefix + "listen_port is not set")
 	}
-	if len(c.params.AllowedFbUids) == 0 {
-		logW.Println(logPrefix + "no users in allowed list - allowed all")
+	if len(c.params.AdminFbUids) == 0 && !c.params.OpenRegistration {
+		logW.Println(logPrefix + "no admin_fb_uids and open_registration is off - only existing admins can approve new users")
 	}
 	if len(c.params.DBPath) == 0 {
 		return fmt.Errorf(logPrefix + "db_path is not set")
 	}
-	if len(c.params.StaticPath) == 0 {
-		return fmt.Errorf(logPrefix + "static_path is not set")
+	if c.params.ReadTimeoutSec < 0 || c.params.WriteTimeoutSec < 0 || c.params.IdleTimeoutSec < 0 {
+		return fmt.Errorf(logPrefix + "server timeouts must not be negative")
+	}
+	if c.params.ShutdownTimeoutSec <= 0 {
+		return fmt.Errorf(logPrefix + "shutdown_timeout_sec must be positive")
+	}
+	if (len(c.params.TLSCertPath) == 0) != (len(c.params.TLSKeyPath) == 0) {
+		return fmt.Errorf(logPrefix + "tls_cert_path and tls_key_path must be set together")
+	}
+	if c.params.HTTPRedirectPort != 0 && !c.TLSEnabled() {
+		return fmt.Errorf(logPrefix + "http_redirect_port requires tls_cert_path and tls_key_path")
+	}
+	if c.params.HTTPRedirectPort != 0 && c.params.HTTPRedirectPort == c.params.ListenPort {
+		return fmt.Errorf(logPrefix + "http_redirect_port must differ from listen_port")
+	}
+	if len(c.params.MetricsUser) > 0 && len(c.params.MetricsPassword) == 0 {
+		return fmt.Errorf(logPrefix + "metrics_password is not set for metrics_user")
+	}
+	for _, name := range c.params.ReadyChecks {
+		known := false
+		for _, k := range knownHealthChecks {
+			known = known || name == k
+		}
+		if !known {
+			return fmt.Errorf(logPrefix+"unknown check %q in ready_checks", name)
+		}
+	}
+	if c.params.AuthProviderCacheSec <= 0 {
+		return fmt.Errorf(logPrefix + "auth_provider_cache_sec must be positive")
+	}
+	if c.params.ConfigWatchSec < 0 {
+		return fmt.Errorf(logPrefix + "config_watch_sec must not be negative")
+	}
+	if c.params.AccountDeletionGraceHours < 0 {
+		return fmt.Errorf(logPrefix + "account_deletion_grace_hours must not be negative")
+	}
+	if c.params.RateLimitIPPerMin < 0 || c.params.RateLimitReadPerMin < 0 ||
+		c.params.RateLimitWritePerMin < 0 || c.params.RateLimitDoPerMin < 0 || c.params.RateLimitTokenPerMin < 0 {
+		return fmt.Errorf(logPrefix + "rate limits must not be negative")
+	}
+	if c.params.CORSMaxAgeSec < 0 {
+		return fmt.Errorf(logPrefix + "cors_max_age_sec must not be negative")
+	}
+	if c.params.WebhookMaxAttempts <= 0 || c.params.WebhookTimeoutSec <= 0 {
+		return fmt.Errorf(logPrefix + "webhook_max_attempts and webhook_timeout_sec must be positive")
+	}
+	if _, err := parseNets(c.params.WebhookAllowedNets); err != nil {
+		return fmt.Errorf(logPrefix+"webhook_allowed_nets: %v", err)
+	}
+	if len(c.params.SMTPAddr) > 0 && len(c.params.SMTPFrom) == 0 {
+		return fmt.Errorf(logPrefix + "smtp_from is not set for smtp_addr")
 	}
 	return nil
 }
+
+func (c *configImpl) TLSEnabled() bool {
+	return len(c.params.TLSCertPath) > 0
+}
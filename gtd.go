@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
 	"time"
@@ -12,105 +13,183 @@ import (
 	"github.com/gorilla/mux"
 
 	"flag"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
+	"sync"
 )
 
 type Activity struct {
-	Id   int64  `json:"id"`
-	Name string `json:"name"`
-	Npom int    `json:"npom"`
+	Id    int64    `json:"id"`
+	CatId int64    `json:"cat_id"`
+	Name  string   `json:"name"`
+	Npom  int      `json:"npom"`
+	Tags  []string `json:"tags"`
+	// Schedule replaces npom every day if set
+	Schedule *schedule `json:"schedule,omitempty"`
+	// Archived is the time activity was archived at, 0 if it is not
+	Archived int64 `json:"archived,omitempty"`
 }
 
 var (
-	logD *log.Logger
-	logI *log.Logger
-	logW *log.Logger
-	logE *log.Logger
+	logD *leveledLogger
+	logI *leveledLogger
+	logW *leveledLogger
+	logE *leveledLogger
 )
 
 var db *sql.DB
 
-func initLoggers(debugMode bool) {
+var authProvider *authProviderStatus
+
+var liveConf *liveConfig
+
+func initLoggers(debugMode bool, format string) error {
+	switch format {
+	case logFormatText, logFormatJSON, logFormatLogfmt:
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
 	debugHandle := ioutil.Discard
 	if debugMode {
 		debugHandle = os.Stdout
 	}
-	logD = log.New(debugHandle, "[D] ", log.Ldate|log.Ltime|log.Lshortfile)
-	logI = log.New(os.Stdout, "[I] ", log.Ldate|log.Ltime|log.Lshortfile)
-	logW = log.New(os.Stdout, "[W] ", log.Ldate|log.Ltime|log.Lshortfile)
-	logE = log.New(os.Stderr, "[E] ", log.Ldate|log.Ltime)
+	var stdoutMu, stderrMu sync.Mutex
+	logD = newLeveledLogger("debug", format, debugHandle, &stdoutMu, "[D] ", log.Ldate|log.Ltime|log.Lshortfile)
+	logI = newLeveledLogger("info", format, os.Stdout, &stdoutMu, "[I] ", log.Ldate|log.Ltime|log.Lshortfile)
+	logW = newLeveledLogger("warn", format, os.Stdout, &stdoutMu, "[W] ", log.Ldate|log.Ltime|log.Lshortfile)
+	logE = newLeveledLogger("error", format, os.Stderr, &stderrMu, "[E] ", log.Ldate|log.Ltime)
+	return nil
 }
 
 type userCtx struct {
 	Id     *uint
 	fbId   string
 	fbName string
+	role   string
+	// preApproved users become active right on registration, without invite or admin approval
+	preApproved bool
+	status      string
 }
 
 type handleFunc func(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string)
 
 type handlerWithAuthCheck struct {
 	handle  handleFunc
-	allowed map[string]bool
+	conf    *liveConfig
+	limiter *rateLimiter
 }
 
 func newHandlerWithAuthCheck(f func(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string),
-	allowed map[string]bool) handlerWithAuthCheck {
-	return handlerWithAuthCheck{f, allowed}
+	conf *liveConfig, limiter *rateLimiter) handlerWithAuthCheck {
+	return handlerWithAuthCheck{f, conf, limiter}
 }
 
 func (h handlerWithAuthCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logPrefix := fmt.Sprintf(">> %s: ", briefDescr(r))
-	logD.Printf(logPrefix)
+	reqLogPrefix := requestLogPrefix(r)
+	logPrefix := reqLogPrefix + ">> "
+	logD.Printf(logPrefix+"headers: %v", r.Header)
 
+	start := time.Now()
 	lrw := &loggingResponseWriter{ResponseWriter: w}
 	defer func() {
-		logPrefix = fmt.Sprintf("<< %s: ", briefDescr(r))
+		observeRequest(r, lrw.statusCode, start)
+		logPrefix = reqLogPrefix + "<< "
 		logD.Printf(logPrefix+"status: %d", lrw.statusCode)
-		logD.Printf(logPrefix+"body: %s\n", lrw.response)
+		logD.Printf(logPrefix+"body: %s", lrw.loggedBody())
 	}()
 
-	user, err := authorize(r, h.allowed)
+	// limit by ip first so that floods do not reach auth provider
+	conf := h.conf.get()
+	if !h.limiter.allowIP(r, conf, logPrefix, lrw) {
+		return
+	}
+
+	// the same token is checked with auth provider on every request, so repeating it gets limited too
+	if key := tokenRateKey(r); len(key) > 0 {
+		if ok, retryAfter := h.limiter.allow(key, conf.params.RateLimitTokenPerMin); !ok {
+			tooManyRequests(logPrefix+"rate limit exceeded for bearer token", retryAfter, lrw)
+			return
+		}
+	}
+
+	user, err := authorize(r)
 	if err != nil {
 		forbidden(logPrefix+"authorize", err, lrw)
 		return
 	}
 
-	uid, err := selectUser(user.fbId)
+	group := rateLimitGroup(r)
+	if ok, retryAfter := h.limiter.allow("user:"+group+":"+user.fbId, conf.rateLimit(group)); !ok {
+		tooManyRequests(logPrefix+"rate limit exceeded for "+group+" requests", retryAfter, lrw)
+		return
+	}
+
+	uid, role, status, err := selectUserAccess(user.fbId)
 	if err != nil {
 		internalError(logPrefix+"select user from db", err, lrw)
 		return
 	}
 
+	configAdmin, preApproved := h.conf.access(user.fbId)
+	// pending users may only register again with invite code to get activated
+	if uid != nil && status != userActive && !configAdmin && !(status == userPending && isRegistration(r)) {
+		metricAuthFailures.WithLabelValues("not_active").Inc()
+		forbidden(logPrefix+"authorize", "user is "+status, lrw)
+		return
+	}
+	if configAdmin {
+		role = roleAdmin
+	}
+
 	user.Id = uid
+	user.role = role
+	user.preApproved = preApproved
+	user.status = status
 
-	h.handle(&user, lrw, r, briefDescr(r)+" ")
+	h.handle(&user, lrw, r, reqLogPrefix)
 }
 
 func main() {
 	debugMode := flag.Bool("debug", false, "debug logging")
-	configPath := flag.String("conf", "/etc/gtd/gtd.conf", "config path")
+	configPath := flag.String("conf", "/etc/gtd/gtd.conf", "config path; empty to use only env and flags")
+	logFormat := flag.String("log-format", logFormatText, "log format: text, json or logfmt")
+	printConf := flag.Bool("print-config", false, "print effective config with value sources and exit")
+	conf := newConfig()
+	confFlags := registerConfigFlags(flag.CommandLine, conf)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, cliUsage+"\nflags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	initLoggers(*debugMode)
+	if flag.NArg() > 0 {
+		os.Exit(runClient(flag.Args()))
+	}
+
+	if err := initLoggers(*debugMode, *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "init loggers: %v\n", err)
+		os.Exit(2)
+	}
 
 	// parse config
-	var conf configImpl
-	if err := InitConfig(*configPath, &conf); err != nil {
+	confLayers := ConfigLayers{Path: *configPath, Env: os.Environ(), Flags: confFlags}
+	confSources, err := InitLayeredConfig(conf, confLayers)
+	if err != nil {
 		logE.Fatalf("init config: %v", err)
 	}
+	if *printConf {
+		printConfig(conf, confSources)
+		return
+	}
 
 	// prepare db
-	var err error
 	_, err = os.Stat(conf.params.DBPath)
 	dbExists := err == nil
 
-	db, err = sql.Open("sqlite3", conf.params.DBPath)
+	db, err = sql.Open(instrumentedSqliteDriver, conf.params.DBPath)
 	if err != nil {
 		logE.Fatalf("create db connection: %v", err)
 	}
@@ -120,64 +199,115 @@ func main() {
 	if !dbExists {
 		logI.Println("db does not exist; creating tables")
 		if err = createTables(); err != nil {
-			log.Fatalf("create tables: %v", err)
+			logE.Fatalf("create tables: %v", err)
 		}
 	} else {
 		logI.Println("db already exists")
 		if err = db.Ping(); err != nil {
-			log.Fatalf("ping db: %v", err)
+			logE.Fatalf("ping db: %v", err)
 		}
 	}
+	if err = migrateDB(); err != nil {
+		logE.Fatalf("migrate db: %v", err)
+	}
 
 	// initialize local variables
-	allowed := make(map[string]bool)
-	for _, id := range conf.params.AllowedFbUids {
-		allowed[id] = true
-	}
+	liveConf = newLiveConfig(confLayers, conf)
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	go liveConf.watch(bgCtx, time.Duration(conf.params.ConfigWatchSec)*time.Second)
+	go runAccountPurger(bgCtx)
+	go runWebhookWorker(bgCtx)
+	go runReminderScheduler(bgCtx)
 
 	// initialize handlers
-	fs := http.FileServer(http.Dir(conf.params.StaticPath))
+	static, err := newAssets(conf.params.StaticPath)
+	if err != nil {
+		logE.Fatalf("load static assets: %v", err)
+	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	http.Handle("/static/", http.StripPrefix("/static/", static.staticHandler()))
+	http.Handle("/metrics", metricsHandler(liveConf.metricsCredentials))
 
+	authProvider = newAuthProviderStatus(time.Duration(conf.params.AuthProviderCacheSec) * time.Second)
+	health, err := newHealthChecker(conf.params.ReadyChecks, authProvider)
+	if err != nil {
+		logE.Fatalf("init health checks: %v", err)
+	}
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", health.readyHandler)
+
+	limiter := newRateLimiter()
 	limitAllowedUsers := func(f handleFunc) handlerWithAuthCheck {
-		return newHandlerWithAuthCheck(f, allowed)
+		return newHandlerWithAuthCheck(f, liveConf, limiter)
 	}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		logD.Println("handling root")
-		t, err := template.ParseFiles(conf.params.StaticPath + "html/index.html")
-		if err != nil {
-			internalError("parse template file", err, w)
-			return
-		}
-		t.Execute(w, nil)
-	})
+	router.HandleFunc("/", static.serveIndex)
+	// boards of share links are public, the token itself grants access
+	// boards cost several queries, so they share the per-ip limit with the api
+	router.Handle("/share/{token:[0-9a-f]+}", limitByIP(boardPageHandler(static), liveConf, limiter)).
+		Methods("GET")
+	router.Handle("/share/{token:[0-9a-f]+}.json", limitByIP(http.HandlerFunc(boardHandler), liveConf, limiter)).
+		Methods("GET")
 
-	router.Handle("/users/new", limitAllowedUsers(newUserHandler)).Methods("POST")
+	withAuth := func(f handleFunc) http.Handler {
+		return limitAllowedUsers(f)
+	}
+	registerAPIv1(router.PathPrefix(apiV1Prefix).Subrouter(), withAuth)
+
+	// legacy unversioned paths kept for old clients
+	registerLegacyAliases(router, deprecatedAlias(withAuth, apiV1Prefix))
 
-	routerCats := router.PathPrefix("/categories").Subrouter()
-	routerCats.Handle("/", limitAllowedUsers(categoriesListHandler)).Methods("GET")
-	routerCats.Handle("/new", limitAllowedUsers(newCategoryHandler)).Methods("POST")
-	routerCats.Handle("/{id:[0-9]+}", limitAllowedUsers(removeCategoryHandler)).Methods("DELETE")
-	routerCats.Handle("/{id:[0-9]+}", limitAllowedUsers(updateCategoryHandler)).Methods("PUT")
+	http.Handle("/", withCORS(router, liveConf))
+	rootHandler := withRequestId(http.DefaultServeMux)
 
-	routerActs := router.PathPrefix("/activities").Subrouter()
-	routerActs.Handle("", limitAllowedUsers(activitiesListHandler)).Methods("GET").
-		Queries("cat_id", "{cat_id:[0-9]+}")
-	routerActs.Handle("/new", limitAllowedUsers(newActivityHandler)).Methods("POST")
-	routerActs.Handle("/{id:[0-9]+}", limitAllowedUsers(removeActivityHandler)).Methods("DELETE")
-	routerActs.Handle("/{id:[0-9]+}", limitAllowedUsers(updateActivityHandler)).Methods("PUT")
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", conf.params.ListenPort),
+		Handler:      rootHandler,
+		ReadTimeout:  time.Duration(conf.params.ReadTimeoutSec) * time.Second,
+		WriteTimeout: time.Duration(conf.params.WriteTimeoutSec) * time.Second,
+		IdleTimeout:  time.Duration(conf.params.IdleTimeoutSec) * time.Second,
+	}
+	servers := []*http.Server{srv}
 
-	router.Handle("/history", limitAllowedUsers(historyHandler)).Methods("GET").
-		Queries("cat_id", "{cat_id:[0-9]+}")
-	router.Handle("/history/do", limitAllowedUsers(doHandler)).Methods("POST")
+	if conf.TLSEnabled() {
+		certs, err := newCertReloader(conf.params.TLSCertPath, conf.params.TLSKeyPath)
+		if err != nil {
+			logE.Fatalf("init tls: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		if conf.params.HSTSMaxAgeSec > 0 {
+			srv.Handler = withHSTS(rootHandler, conf.params.HSTSMaxAgeSec)
+		}
 
-	http.Handle("/", router)
+		if conf.params.HTTPRedirectPort != 0 {
+			logI.Printf("redirecting http port %d to https", conf.params.HTTPRedirectPort)
+			servers = append(servers, &http.Server{
+				Addr:         fmt.Sprintf(":%d", conf.params.HTTPRedirectPort),
+				Handler:      httpsRedirectHandler(conf.params.ListenPort),
+				ReadTimeout:  srv.ReadTimeout,
+				WriteTimeout: srv.WriteTimeout,
+				IdleTimeout:  srv.IdleTimeout,
+			})
+		}
+	}
 
-	logI.Printf("start listening port %d :)", conf.params.ListenPort)
-	http.ListenAndServe(fmt.Sprintf(":%d", conf.params.ListenPort), nil)
+	logI.Printf("start listening port %d (tls: %t) :)", conf.params.ListenPort, conf.TLSEnabled())
+	// systemd hears of readiness only once the ports are open
+	err = serve(time.Duration(conf.params.ShutdownTimeoutSec)*time.Second, func() { go runWatchdog(bgCtx, health) },
+		servers...)
+	stopBackground()
+	sdNotify("STOPPING=1")
+	if closeErr := db.Close(); closeErr != nil {
+		logE.Printf("close db: %v", closeErr)
+	}
+	if err != nil {
+		logE.Fatalf("serve: %v", err)
+	}
+	logI.Println("bye")
 }
 
 func createTables() error {
@@ -255,26 +385,129 @@ func createTables() error {
 
 // Handlers -->
 
-func newUserHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
-	if user.Id == nil {
-		logD.Printf("no user with fb id=%s found; creating new user record", user.fbId)
-		var err error
-		var stmt *sql.Stmt
-		stmt, err = db.Prepare(`INSERT INTO users VALUES (NULL, ?, ?, ?);`)
+func newUserHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	var newUserRequest struct {
+		InviteCode string `json:"invite_code"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&newUserRequest); err != nil && err != io.EOF {
+		badRequest(logPrefix+"decode new user request", err, w)
+		return
+	}
+
+	if user.Id != nil {
+		if user.status == userPending && len(newUserRequest.InviteCode) > 0 {
+			redeemInviteCode(user, newUserRequest.InviteCode, w, logPrefix)
+			return
+		}
+		logD.Println(logPrefix + "user already exists in db")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	logD.Printf(logPrefix+"no user with fb id=%s found; creating new user record", user.fbId)
+	status := userPending
+	if user.preApproved {
+		status = userActive
+	}
+	role := roleUser
+	if user.role == roleAdmin {
+		role = roleAdmin
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	now := int(time.Now().Unix() * 1000)
+	execRes, err := tx.Exec(`INSERT INTO users (registered, fb_id, name, role, status) VALUES (?, ?, ?, ?, ?);`,
+		now, user.fbId, user.fbName, role, status)
+	if err != nil {
+		internalError(logPrefix+"exec insert new user query", err, w)
+		return
+	}
+
+	if status == userPending && len(newUserRequest.InviteCode) > 0 {
+		newId, err := execRes.LastInsertId()
 		if err != nil {
-			internalError(logPrefix+"prepare insert new user query", err, w)
+			internalError(logPrefix+"get last insert id", err, w)
 			return
 		}
-		now := int(time.Now().Unix() * 1000)
-		if _, err = stmt.Exec(now, user.fbId, user.fbName); err != nil {
-			internalError(logPrefix+"exec insert new user query", err, w)
+		used, err := activateWithInvite(tx, newUserRequest.InviteCode, newId)
+		if err != nil {
+			internalError(logPrefix+"use invite", err, w)
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
+		if !used {
+			forbidden(logPrefix+"invalid or expired invite code", nil, w)
+			return
+		}
+		status = userActive
+	}
+
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit new user", err, w)
+		return
+	}
+	metricCreated.WithLabelValues("user").Inc()
+
+	if status == userPending {
+		logI.Printf(logPrefix+"user with fb id=%s registered and awaits approval", user.fbId)
+		w.WriteHeader(http.StatusAccepted)
 	} else {
-		logD.Println(logPrefix + "user already exists in db")
-		w.WriteHeader(http.StatusConflict)
+		w.WriteHeader(http.StatusCreated)
+	}
+	fmt.Fprint(w, fmt.Sprintf(`{"status":%q}`, status))
+}
+
+// redeemInviteCode activates user who registered without invite and still awaits approval
+func redeemInviteCode(user *userCtx, code string, w http.ResponseWriter, logPrefix string) {
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	used, err := activateWithInvite(tx, code, int64(*user.Id))
+	if err != nil {
+		internalError(logPrefix+"use invite", err, w)
+		return
 	}
+	if !used {
+		forbidden(logPrefix+"invalid or expired invite code", nil, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit user activation", err, w)
+		return
+	}
+	logI.Printf(logPrefix+"pending user %d activated with invite", *user.Id)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, fmt.Sprintf(`{"status":%q}`, userActive))
+}
+
+// activateWithInvite marks invite code used by user uid and activates the user; it returns false if the code
+// is invalid, expired or used already
+func activateWithInvite(tx *sql.Tx, code string, uid int64) (bool, error) {
+	used, err := useInvite(tx, code, uid)
+	if err != nil || !used {
+		return false, err
+	}
+	if _, err = tx.Exec(`UPDATE users SET status=? WHERE id=?;`, userActive, uid); err != nil {
+		return false, fmt.Errorf("exec activate user query: %v", err)
+	}
+	return true, nil
+}
+
+// isRegistration reports whether r is a request to register a user
+func isRegistration(r *http.Request) bool {
+	return r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/users/new")
 }
 
 func doHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
@@ -285,13 +518,34 @@ func doHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix
 	defer r.Body.Close()
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&doRequest); err != nil {
-		badRequest("decode do request", err, w)
+		badRequest(logPrefix+"decode do request", err, w)
 		return
 	}
 
 	uid, err := selectUser(user.fbId)
 	if err != nil || uid == nil {
-		internalError("select uid", err, w)
+		internalError(logPrefix+"select uid", err, w)
+		return
+	}
+
+	accessible, err := activityAccessibleBy(doRequest.ActivityId, *uid)
+	if err != nil {
+		internalError(logPrefix+"check activity access", err, w)
+		return
+	}
+	if !accessible {
+		httpError(logPrefix+"activity not found", doRequest.ActivityId, http.StatusNotFound, w)
+		return
+	}
+
+	var archived bool
+	if err = db.QueryRow(`SELECT count(*) > 0 FROM activities WHERE id=? AND archived IS NOT NULL;`,
+		doRequest.ActivityId).Scan(&archived); err != nil {
+		internalError(logPrefix+"check if activity is archived", err, w)
+		return
+	}
+	if archived {
+		httpError(logPrefix+"activity is archived", doRequest.ActivityId, http.StatusConflict, w)
 		return
 	}
 
@@ -306,27 +560,40 @@ func doHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix
 		internalError(logPrefix+"exec insert new action query", err, w)
 		return
 	}
+	metricPomodoros.Add(float64(doRequest.DoneVal))
 
-	done, err := doneToday(doRequest.ActivityId)
+	done, err := doneToday(doRequest.ActivityId, *uid)
 	if err != nil {
 		internalError(logPrefix+"select all pomodoros done today for this activity", err, w)
 		return
 	}
 
-	rows, err := db.Query(`SELECT npom FROM activities WHERE id=?;`, doRequest.ActivityId)
+	target, err := selectActivityTarget(db, doRequest.ActivityId)
 	if err != nil {
-		internalError(logPrefix+"select npom from activities", err, w)
+		internalError(logPrefix+"select activity target", err, w)
 		return
 	}
-	defer rows.Close()
-
-	var total int
-	for rows.Next() {
-		err = rows.Scan(&total)
+	today := time.Now()
+	fireEvent(logPrefix, *uid, eventPomodoroLogged, map[string]interface{}{
+		"activity_id": doRequest.ActivityId, "done_value": doRequest.DoneVal, "done_today": done, "logged": now})
+
+	// target is reached by the pomodoro which makes done cross it
+	reached := func(period string, target, done int) {
+		if target > 0 && done >= target && done-doRequest.DoneVal < target {
+			fireEvent(logPrefix, *uid, eventTargetReached, map[string]interface{}{
+				"activity_id": doRequest.ActivityId, "period": period, "target": target, "done": done})
+		}
+	}
+	left := target.daily(today) - done
+	reached("day", target.daily(today), done)
+	if perWeek, ok := target.weekly(today); ok {
+		doneWeek, err := doneSince(doRequest.ActivityId, *uid, weekBegin(today))
 		if err != nil {
-			internalError(logPrefix+"read next row", err, w)
+			internalError(logPrefix+"select all pomodoros done this week for this activity", err, w)
 			return
 		}
+		left = perWeek - doneWeek
+		reached("week", perWeek, doneWeek)
 	}
 
 	b := struct {
@@ -334,7 +601,7 @@ func doHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix
 		NewValue    int   `json:"new_value"`
 		Left        int   `json:"left"`
 		LastUpdated int   `json:"last_updated"`
-	}{doRequest.ActivityId, done, total - done, now}
+	}{doRequest.ActivityId, done, left, now}
 	body, err := json.Marshal(b)
 	if err != nil {
 		internalError(logPrefix+"encode response", err, w)
@@ -350,26 +617,46 @@ func historyHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPr
 		return
 	}
 
-	catIdStr := r.URL.Query().Get("cat_id")
-	if len(catIdStr) == 0 {
-		badRequest(logPrefix+"invalid cat_id query param", nil, w)
+	filter, err := parseActivityFilter(r)
+	if err != nil {
+		badRequest(logPrefix+"invalid query params", err, w)
+		return
+	}
+	// history of a category includes activities of its subcategories
+	filter.subcats = true
+	h, err := selectWeekHist(*user.Id, filter)
+	if err != nil {
+		internalError(logPrefix+"select week hist", err, w)
 		return
 	}
 
-	catId, err := strconv.ParseInt(catIdStr, 10, 64)
+	respBody, err := json.Marshal(h)
 	if err != nil {
-		badRequest(logPrefix+"not a num cat_id query param", err, w)
+		internalError(logPrefix+"encode week hist", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// categoriesHistoryHandler responds with pomodoros done during the week in each category, counting
+// those of subcategories as well
+func categoriesHistoryHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
 		return
 	}
-	h, err := selectWeekHist(*user.Id, catId)
+
+	h, err := selectCategoryWeekHist(*user.Id)
 	if err != nil {
-		internalError("select week hist", err, w)
+		internalError(logPrefix+"select category week hist", err, w)
 		return
 	}
 
 	respBody, err := json.Marshal(h)
 	if err != nil {
-		internalError("encode week hist", err, w)
+		internalError(logPrefix+"encode category week hist", err, w)
 		return
 	}
 
@@ -377,28 +664,44 @@ func historyHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPr
 	fmt.Fprint(w, string(respBody))
 }
 
-func categoriesListHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+// categoryNode is a category with its subcategories
+type categoryNode struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	ParentId int64  `json:"parent_id,omitempty"`
+	Archived int64  `json:"archived,omitempty"`
+	// OwnerId is set for categories shared with user by their owner
+	OwnerId  int64           `json:"owner_id,omitempty"`
+	Children []*categoryNode `json:"children"`
+}
+
+// categoriesListHandler responds with the forest of user's categories; archived ones are left out unless
+// include_archived is set
+func categoriesListHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
 	if user.Id == nil {
 		forbidden(logPrefix+"user not found in db", nil, w)
 		return
 	}
 
-	rows, err := db.Query(`SELECT C.id, C.name FROM categories C
-WHERE C.user_id=?;`, *user.Id)
+	includeArchived, err := parseIncludeArchived(r)
+	if err != nil {
+		badRequest(logPrefix+"invalid query params", err, w)
+		return
+	}
+
+	// shared categories are listed as roots without owner's subcategories
+	rows, err := db.Query(`SELECT C.id, C.name, CASE WHEN C.user_id=? THEN IFNULL(C.parent_id, 0) ELSE 0 END,
+IFNULL(C.archived, 0), CASE WHEN C.user_id=? THEN 0 ELSE C.user_id END FROM categories C
+WHERE C.user_id=? OR C.id IN (`+memberCategoriesQuery+`) ORDER BY C.id ASC;`, *user.Id, *user.Id, *user.Id, *user.Id)
 	if err != nil {
 		internalError(logPrefix+"select categories list from db", err, w)
 		return
 	}
 	defer rows.Close()
-	type catInfo struct {
-		Id   int64  `json:"id"`
-		Name string `json:"name"`
-	}
-	var catList []catInfo
-
+	var catList []*categoryNode
 	for rows.Next() {
-		var cat catInfo
-		err = rows.Scan(&cat.Id, &cat.Name)
+		cat := &categoryNode{Children: []*categoryNode{}}
+		err = rows.Scan(&cat.Id, &cat.Name, &cat.ParentId, &cat.Archived, &cat.OwnerId)
 		if err != nil {
 			internalError(logPrefix+"read next row", err, w)
 			return
@@ -406,9 +709,13 @@ WHERE C.user_id=?;`, *user.Id)
 		catList = append(catList, cat)
 	}
 
-	respBody, err := json.Marshal(catList)
+	roots := categoryTree(catList)
+	if !includeArchived {
+		roots = pruneArchived(roots)
+	}
+	respBody, err := json.Marshal(roots)
 	if err != nil {
-		internalError("encode activities list", err, w)
+		internalError(logPrefix+"encode activities list", err, w)
 		return
 	}
 
@@ -416,6 +723,23 @@ WHERE C.user_id=?;`, *user.Id)
 	fmt.Fprint(w, string(respBody))
 }
 
+// categoryTree links cats into trees and returns their roots; categories with parent missing from cats
+// become roots as well
+func categoryTree(cats []*categoryNode) (roots []*categoryNode) {
+	byId := make(map[int64]*categoryNode, len(cats))
+	for _, cat := range cats {
+		byId[cat.Id] = cat
+	}
+	for _, cat := range cats {
+		if parent, found := byId[cat.ParentId]; found {
+			parent.Children = append(parent.Children, cat)
+		} else {
+			roots = append(roots, cat)
+		}
+	}
+	return
+}
+
 func newCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
 	if user.Id == nil {
 		forbidden(logPrefix+"user not found in db", nil, w)
@@ -423,7 +747,8 @@ func newCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, l
 	}
 
 	var newCategoryRequest struct {
-		Name string `json:"name"`
+		Name     string `json:"name"`
+		ParentId int64  `json:"parent_id"`
 	}
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&newCategoryRequest); err != nil {
@@ -431,15 +756,29 @@ func newCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, l
 		return
 	}
 
-	stmt, err := db.Prepare(`INSERT INTO categories VALUES (NULL, ?, ?);`)
+	var parentId interface{}
+	if newCategoryRequest.ParentId != 0 {
+		owned, err := categoryOwnedBy(newCategoryRequest.ParentId, *user.Id)
+		if err != nil {
+			internalError(logPrefix+"check parent category owner", err, w)
+			return
+		}
+		if !owned {
+			httpError(logPrefix+"parent category not found", newCategoryRequest.ParentId, http.StatusNotFound, w)
+			return
+		}
+		parentId = newCategoryRequest.ParentId
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO categories (name, user_id, parent_id) VALUES (?, ?, ?);`)
 	if err != nil {
 		internalError(logPrefix+"prepare insert new category query", err, w)
 		return
 	}
 
 	var execRes sql.Result
-	if execRes, err = stmt.Exec(newCategoryRequest.Name, *user.Id); err != nil {
-		internalError("exec insert new category query", err, w)
+	if execRes, err = stmt.Exec(newCategoryRequest.Name, *user.Id, parentId); err != nil {
+		internalError(logPrefix+"exec insert new category query", err, w)
 		return
 	}
 
@@ -448,6 +787,9 @@ func newCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, l
 		internalError(logPrefix+"get last insert id", err, w)
 		return
 	}
+	metricCreated.WithLabelValues("category").Inc()
+	fireEvent(logPrefix, *user.Id, eventCategoryCreated, map[string]interface{}{
+		"id": newId, "name": newCategoryRequest.Name, "parent_id": newCategoryRequest.ParentId})
 
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprint(w, fmt.Sprintf(`{"id":%d}`, newId))
@@ -465,32 +807,56 @@ func removeCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	logD.Printf(logPrefix+"removing category %d", catId)
-
-	// Remove row from categories
-	stmt, err := db.Prepare(`DELETE FROM categories WHERE id=?;`)
+	owned, err := categoryOwnedBy(catId, *user.Id)
 	if err != nil {
-		internalError(logPrefix+"failed to prepare delete query: %v", err, w)
+		internalError(logPrefix+"check category owner", err, w)
 		return
 	}
-
-	if _, err = stmt.Exec(catId); err != nil {
-		internalError("exec remove category query", err, w)
+	if !owned {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
 		return
 	}
 
-	// Remove corresponding rows from activities
-	stmt, err = db.Prepare(`DELETE FROM activities WHERE category_id=?;`)
+	logD.Printf(logPrefix+"removing category %d", catId)
+
+	tx, err := db.Begin()
 	if err != nil {
-		internalError(logPrefix+"failed to prepare delete query: %v", err, w)
+		internalError(logPrefix+"begin tx", err, w)
 		return
 	}
+	defer tx.Rollback()
 
-	if _, err = stmt.Exec(catId); err != nil {
-		internalError("exec remove activities query", err, w)
+	// Subcategories move up to the parent of removed category
+	if _, err = tx.Exec(`UPDATE categories SET parent_id=(SELECT parent_id FROM categories WHERE id=?1)
+WHERE parent_id=?1;`, catId); err != nil {
+		internalError(logPrefix+"exec reparent subcategories query", err, w)
 		return
 	}
 
+	// Remove row from categories along with everything attached to the category and its activities
+	for _, q := range []struct{ descr, query string }{
+		{"category", `DELETE FROM categories WHERE id=?;`},
+		{"category members", `DELETE FROM category_members WHERE category_id=?;`},
+		{"share links", `DELETE FROM share_links WHERE category_id=?;`},
+		{"activity tags", `DELETE FROM activity_tags WHERE activity_id IN
+(SELECT id FROM activities WHERE category_id=?);`},
+		{"targets", `DELETE FROM activity_targets WHERE activity_id IN
+(SELECT id FROM activities WHERE category_id=?);`},
+		{"reminder opt-outs", `DELETE FROM reminder_optouts WHERE activity_id IN
+(SELECT id FROM activities WHERE category_id=?);`},
+		{"activities", `DELETE FROM activities WHERE category_id=?;`},
+	} {
+		if _, err = tx.Exec(q.query, catId); err != nil {
+			internalError(logPrefix+"exec remove "+q.descr+" query", err, w)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+	fireEvent(logPrefix, *user.Id, eventCategoryDeleted, map[string]interface{}{"id": catId})
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -521,6 +887,16 @@ func updateCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	owned, err := categoryOwnedBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
 	logD.Printf(logPrefix+"renaming category %d", catId)
 
 	stmt, err := db.Prepare(`UPDATE categories SET name=? WHERE id=?;`)
@@ -530,7 +906,82 @@ func updateCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 	}
 
 	if _, err = stmt.Exec(newCatName, catId); err != nil {
-		internalError("exec remove category query", err, w)
+		internalError(logPrefix+"exec remove category query", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// pruneArchived drops archived categories with their subtrees
+func pruneArchived(cats []*categoryNode) []*categoryNode {
+	kept := []*categoryNode{}
+	for _, cat := range cats {
+		if cat.Archived == 0 {
+			cat.Children = pruneArchived(cat.Children)
+			kept = append(kept, cat)
+		}
+	}
+	return kept
+}
+
+// moveCategoryHandler makes category with its whole subtree a child of another category or a root one if
+// parent_id is 0
+func moveCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var moveCategoryRequest struct {
+		ParentId int64 `json:"parent_id"`
+	}
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&moveCategoryRequest); err != nil {
+		badRequest(logPrefix+"decode move category request body", err, w)
+		return
+	}
+
+	subtree, err := selectCategorySubtree(*user.Id, catId)
+	if err != nil {
+		internalError(logPrefix+"select category subtree", err, w)
+		return
+	}
+	if len(subtree) == 0 {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	var parentId interface{}
+	if moveCategoryRequest.ParentId != 0 {
+		for _, id := range subtree {
+			if id == moveCategoryRequest.ParentId {
+				badRequest(logPrefix+"cannot move category into its own subtree", moveCategoryRequest.ParentId, w)
+				return
+			}
+		}
+		owned, err := categoryOwnedBy(moveCategoryRequest.ParentId, *user.Id)
+		if err != nil {
+			internalError(logPrefix+"check parent category owner", err, w)
+			return
+		}
+		if !owned {
+			httpError(logPrefix+"parent category not found", moveCategoryRequest.ParentId, http.StatusNotFound, w)
+			return
+		}
+		parentId = moveCategoryRequest.ParentId
+	}
+
+	logD.Printf(logPrefix+"moving category %d under %v", catId, parentId)
+
+	if _, err = db.Exec(`UPDATE categories SET parent_id=? WHERE id=?;`, parentId, catId); err != nil {
+		internalError(logPrefix+"exec move category query", err, w)
 		return
 	}
 
@@ -543,24 +994,37 @@ func activitiesListHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	catIdStr := r.URL.Query().Get("cat_id")
-	if len(catIdStr) == 0 {
-		badRequest(logPrefix+"invalid cat_id query param", nil, w)
+	filter, err := parseActivityFilter(r)
+	if err != nil {
+		badRequest(logPrefix+"invalid query params", err, w)
+		return
+	}
+	includeArchived, err := parseIncludeArchived(r)
+	if err != nil {
+		badRequest(logPrefix+"invalid query params", err, w)
 		return
 	}
+	filter.skipArchived = !includeArchived
 
-	catId, err := strconv.ParseInt(catIdStr, 10, 64)
+	tags, err := selectActivityTags(*user.Id)
 	if err != nil {
-		badRequest(logPrefix+"not a num cat_id query param", err, w)
+		internalError(logPrefix+"select activity tags", err, w)
 		return
 	}
+	targets, err := selectTargetHistories(*user.Id, filter)
+	if err != nil {
+		internalError(logPrefix+"select activity targets", err, w)
+		return
+	}
+	now := time.Now()
 
+	where, args := filter.where(*user.Id)
 	var rows *sql.Rows
-	rows, err = db.Query(`SELECT A.id, A.name, A.npom FROM activities A
-JOIN categories C ON A.category_id = C.id WHERE C.id=? AND C.user_id=?
-ORDER BY vorder ASC;`, catId, *user.Id)
+	rows, err = db.Query(`SELECT A.id, A.category_id, A.name, A.npom, IFNULL(A.archived, 0) FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE `+where+`
+ORDER BY vorder ASC;`, args...)
 	if err != nil {
-		internalError("select activities list", err, w)
+		internalError(logPrefix+"select activities list", err, w)
 		return
 	}
 	defer rows.Close()
@@ -570,11 +1034,16 @@ ORDER BY vorder ASC;`, catId, *user.Id)
 	}
 	for rows.Next() {
 		var a Activity
-		err = rows.Scan(&a.Id, &a.Name, &a.Npom)
+		err = rows.Scan(&a.Id, &a.CatId, &a.Name, &a.Npom, &a.Archived)
 		if err != nil {
 			internalError(logPrefix+"read next row", err, w)
 			return
 		}
+		a.Tags = tags[a.Id]
+		if a.Tags == nil {
+			a.Tags = []string{}
+		}
+		a.Schedule = targets[a.Id].at(now).sched
 		aclist.Activities = append(aclist.Activities, a)
 	}
 
@@ -590,7 +1059,7 @@ ORDER BY vorder ASC;`, catId, *user.Id)
 
 func newActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
 	if user.Id == nil {
-		forbidden("user not found in db", nil, w)
+		forbidden(logPrefix+"user not found in db", nil, w)
 		return
 	}
 	var newAct struct {
@@ -605,14 +1074,26 @@ func newActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request, l
 		return
 	}
 
-	stmt, err := db.Prepare(`INSERT INTO activities VALUES (NULL, ?, ?, ?, ?, (SELECT
-IFNULL(max(vorder), 0) FROM activities) + 1);`)
+	owned, err := categoryOwnedBy(newAct.CatId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"category not found", newAct.CatId, http.StatusNotFound, w)
+		return
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		internalError(logPrefix+"prepare insert new activity query", err, w)
+		internalError(logPrefix+"begin tx", err, w)
 		return
 	}
+	defer tx.Rollback()
 
-	execRes, err := stmt.Exec(newAct.Name, newAct.Npoms, time.Now().Unix()*1000, newAct.CatId)
+	execRes, err := tx.Exec(`INSERT INTO activities (name, npom, createtime, category_id, vorder)
+VALUES (?, ?, ?, ?, (SELECT IFNULL(max(vorder), 0) FROM activities) + 1);`,
+		newAct.Name, newAct.Npoms, time.Now().Unix()*1000, newAct.CatId)
 	if err != nil {
 		internalError(logPrefix+"exec insert new activity query", err, w)
 		return
@@ -622,6 +1103,17 @@ IFNULL(max(vorder), 0) FROM activities) + 1);`)
 		internalError(logPrefix+"get last insert id", err, w)
 		return
 	}
+	if err = saveTarget(tx, newId, activityTarget{npom: newAct.Npoms}); err != nil {
+		internalError(logPrefix+"save activity target", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+	metricCreated.WithLabelValues("activity").Inc()
+	fireEvent(logPrefix, *user.Id, eventActivityCreated, map[string]interface{}{
+		"id": newId, "cat_id": newAct.CatId, "name": newAct.Name, "npom": newAct.Npoms})
 
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprint(w, fmt.Sprintf(`{"id":%d}`, newId))
@@ -639,19 +1131,42 @@ func removeActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	owned, err := activityOwnedBy(actId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check activity owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"activity not found", actId, http.StatusNotFound, w)
+		return
+	}
+
 	logD.Printf(logPrefix+"removing activity %d", actId)
 
-	// Remove row from activities
-	stmt, err := db.Prepare(`DELETE FROM activities WHERE id=?;`)
+	tx, err := db.Begin()
 	if err != nil {
-		internalError(logPrefix+"failed to prepare delete query: %v", err, w)
+		internalError(logPrefix+"begin tx", err, w)
 		return
 	}
-
-	if _, err = stmt.Exec(actId); err != nil {
-		internalError("exec remove activity query", err, w)
+	defer tx.Rollback()
+
+	// Remove row from activities along with everything attached to it
+	for _, q := range []struct{ descr, query string }{
+		{"activity", `DELETE FROM activities WHERE id=?;`},
+		{"activity tags", `DELETE FROM activity_tags WHERE activity_id=?;`},
+		{"targets", `DELETE FROM activity_targets WHERE activity_id=?;`},
+		{"reminder opt-outs", `DELETE FROM reminder_optouts WHERE activity_id=?;`},
+	} {
+		if _, err = tx.Exec(q.query, actId); err != nil {
+			internalError(logPrefix+"exec remove "+q.descr+" query", err, w)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
 		return
 	}
+	fireEvent(logPrefix, *user.Id, eventActivityDeleted, map[string]interface{}{"id": actId})
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -683,16 +1198,46 @@ func updateActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	owned, err := activityOwnedBy(actId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check activity owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"activity not found", actId, http.StatusNotFound, w)
+		return
+	}
+
 	logD.Printf(logPrefix+"updating activity %d", actId)
 
-	stmt, err := db.Prepare(`UPDATE activities SET name=?, npom=? WHERE id=?;`)
+	tx, err := db.Begin()
 	if err != nil {
-		internalError(logPrefix+"failed to prepare update query: %v", err, w)
+		internalError(logPrefix+"begin tx", err, w)
 		return
 	}
+	defer tx.Rollback()
 
-	if _, err = stmt.Exec(updateActivityRequest.NewName, updateActivityRequest.NewNpom, actId); err != nil {
-		internalError("exec remove activity query", err, w)
+	// Changed npom becomes a new target version so that past days are still measured against the old one
+	target, err := selectActivityTarget(tx, actId)
+	if err != nil {
+		internalError(logPrefix+"select activity target", err, w)
+		return
+	}
+	if target.npom != updateActivityRequest.NewNpom {
+		target.npom = updateActivityRequest.NewNpom
+		if err = saveTarget(tx, actId, target); err != nil {
+			internalError(logPrefix+"save activity target", err, w)
+			return
+		}
+	}
+
+	if _, err = tx.Exec(`UPDATE activities SET name=?, npom=? WHERE id=?;`,
+		updateActivityRequest.NewName, updateActivityRequest.NewNpom, actId); err != nil {
+		internalError(logPrefix+"exec update activity query", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
 		return
 	}
 
@@ -702,10 +1247,11 @@ func updateActivityHandler(user *userCtx, w http.ResponseWriter, r *http.Request
 // <-- Handlers
 
 // Authorize by parsing bearer token from header and returns retrieved from fb /me info
-func authorize(r *http.Request, allowed map[string]bool) (user userCtx, err error) {
+func authorize(r *http.Request) (user userCtx, err error) {
 	authHdr := r.Header.Get("Authorization")
 	bearerPrefix := "Bearer "
 	if !strings.HasPrefix(authHdr, bearerPrefix) || len(authHdr) == len(bearerPrefix) {
+		metricAuthFailures.WithLabelValues("invalid_header").Inc()
 		err = fmt.Errorf("received invalid auth header: %s", authHdr)
 		return
 	}
@@ -716,9 +1262,12 @@ func authorize(r *http.Request, allowed map[string]bool) (user userCtx, err erro
 		err = fmt.Errorf("prepare GET /me request: %v", err)
 		return
 	}
+	start := time.Now()
 	respFbMe, err := httpc.Do(req)
+	metricAuthDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		err = fmt.Errorf("process /me request", err)
+		metricAuthFailures.WithLabelValues("provider_request").Inc()
+		err = fmt.Errorf("process /me request: %v", err)
 		return
 	}
 	defer respFbMe.Body.Close()
@@ -728,14 +1277,13 @@ func authorize(r *http.Request, allowed map[string]bool) (user userCtx, err erro
 	}
 	dec := json.NewDecoder(respFbMe.Body)
 	if err = dec.Decode(&fbMe); err != nil {
-		err = fmt.Errorf("decode /me body", err)
-		return
-	}
-	if _, found := allowed[fbMe.Id]; !found {
-		err = fmt.Errorf("not in allowed list")
+		metricAuthFailures.WithLabelValues("provider_response").Inc()
+		err = fmt.Errorf("decode /me body: %v", err)
 		return
 	}
+	authProvider.reportOK()
 	if len(fbMe.Name) == 0 || len(fbMe.Id) == 0 {
+		metricAuthFailures.WithLabelValues("provider_response").Inc()
 		err = fmt.Errorf("unexpected /me body: %v", respFbMe)
 		return
 	}
@@ -766,14 +1314,35 @@ func selectUser(fbId string) (uid *uint, err error) {
 	return
 }
 
-func selectWeekHist(uid uint, catId int64) (hist map[int64][7]int, err error) {
-	weekAgo := time.Now().AddDate(0, 0, -6)
-	weekStart := time.Date(weekAgo.Year(), weekAgo.Month(), weekAgo.Day(), 0, 0, 0, 0, weekAgo.Location())
+// selectUserAccess returns nil uid if there is no user with fbId
+func selectUserAccess(fbId string) (uid *uint, role, status string, err error) {
+	var id uint
+	err = db.QueryRow(`SELECT id, role, status FROM users WHERE fb_id=?;`, fbId).Scan(&id, &role, &status)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf(`select user access from table "users": %v`, err)
+		return
+	}
+	uid = &id
+	return
+}
+
+// histWeekStart returns the beginning of the first of 7 days ending with today
+func histWeekStart() time.Time {
+	return dayBegin(time.Now().AddDate(0, 0, -6))
+}
+
+func selectWeekHist(uid uint, filter activityFilter) (hist map[int64][7]int, err error) {
+	weekStart := histWeekStart()
+	where, args := filter.where(uid)
 	var rows *sql.Rows
 	rows, err = db.Query(`SELECT A.id, H.tstamp, H.done
 FROM history H JOIN activities A ON H.activity_id = A.id
-JOIN categories C ON A.category_id = C.id JOIN users U ON C.user_id = U.id
-WHERE U.id = ? AND C.id = ? AND H.tstamp >= ?;`, uid, catId, weekStart.Unix()*1000)
+JOIN categories C ON A.category_id = C.id
+WHERE `+where+` AND H.user_id = ? AND H.tstamp >= ?;`, append(args, uid, weekStart.Unix()*1000)...)
 	if err != nil {
 		err = fmt.Errorf("select week history: %v", err)
 		return
@@ -797,17 +1366,141 @@ WHERE U.id = ? AND C.id = ? AND H.tstamp >= ?;`, uid, catId, weekStart.Unix()*10
 	return
 }
 
-func doneToday(activityId int64) (total int, err error) {
-	today := time.Now()
-	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
-	todayTs := today.Unix() * 1000
+// categorySubtreeQuery selects ids of a category and all its descendants; args are category id and
+// id of the user it must belong to
+const categorySubtreeQuery = `WITH RECURSIVE subtree(id) AS (
+SELECT id FROM categories WHERE id = ? AND user_id = ?
+UNION SELECT SC.id FROM categories SC JOIN subtree ON SC.parent_id = subtree.id)
+SELECT id FROM subtree`
+
+// archivedCategoriesQuery selects ids of archived categories of a user, own or shared with them, and all their
+// descendants; args are user id twice
+const archivedCategoriesQuery = `WITH RECURSIVE archived_tree(id) AS (
+SELECT id FROM categories WHERE archived IS NOT NULL AND (user_id = ? OR id IN (` + memberCategoriesQuery + `))
+UNION SELECT SC.id FROM categories SC JOIN archived_tree ON SC.parent_id = archived_tree.id)
+SELECT id FROM archived_tree`
+
+// selectCategorySubtree returns ids of category catId and all its descendants or nothing if user uid
+// has no such category
+func selectCategorySubtree(uid uint, catId int64) (ids []int64, err error) {
 	var rows *sql.Rows
-	rows, err = db.Query(`SELECT H.done
+	rows, err = db.Query(categorySubtreeQuery+";", catId, uid)
+	if err != nil {
+		err = fmt.Errorf("select category subtree: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			err = fmt.Errorf("scan next row: %v", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// categoryOwnedBy reports whether category catId belongs to user uid
+func categoryOwnedBy(catId int64, uid uint) (owned bool, err error) {
+	err = db.QueryRow(`SELECT count(*) > 0 FROM categories WHERE id = ? AND user_id = ?;`, catId, uid).Scan(&owned)
+	if err != nil {
+		err = fmt.Errorf("select category owner: %v", err)
+	}
+	return
+}
+
+// activityOwnedBy reports whether activity actId is in one of categories of user uid
+func activityOwnedBy(actId int64, uid uint) (owned bool, err error) {
+	err = db.QueryRow(`SELECT count(*) > 0 FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE A.id = ? AND C.user_id = ?;`, actId, uid).Scan(&owned)
+	if err != nil {
+		err = fmt.Errorf("select activity owner: %v", err)
+	}
+	return
+}
+
+// selectCategoryWeekHist sums week history of user uid per category with totals of each category
+// added to all its ancestors
+func selectCategoryWeekHist(uid uint) (hist map[int64][7]int, err error) {
+	var rows *sql.Rows
+	// shared categories are roots for members as categoriesListHandler lists them
+	rows, err = db.Query(`SELECT id, CASE WHEN user_id = ? THEN IFNULL(parent_id, 0) ELSE 0 END FROM categories
+WHERE user_id = ? OR id IN (`+memberCategoriesQuery+`);`, uid, uid, uid)
+	if err != nil {
+		err = fmt.Errorf("select categories: %v", err)
+		return
+	}
+	parents := make(map[int64]int64)
+	hist = make(map[int64][7]int)
+	for rows.Next() {
+		var id, parentId int64
+		if err = rows.Scan(&id, &parentId); err != nil {
+			rows.Close()
+			err = fmt.Errorf("scan next category: %v", err)
+			return
+		}
+		parents[id] = parentId
+		hist[id] = [7]int{}
+	}
+	rows.Close()
+
+	weekStart := histWeekStart()
+	rows, err = db.Query(`SELECT C.id, H.tstamp, H.done
 FROM history H JOIN activities A ON H.activity_id = A.id
 JOIN categories C ON A.category_id = C.id
-WHERE A.id = ? AND H.tstamp >= ?;`, activityId, todayTs)
+WHERE (C.user_id = ? OR C.id IN (`+memberCategoriesQuery+`)) AND H.user_id = ? AND H.tstamp >= ?;`,
+		uid, uid, uid, weekStart.Unix()*1000)
 	if err != nil {
 		err = fmt.Errorf("select week history: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var catId int64
+		var tstamp time.Time
+		var done int
+		if err = rows.Scan(&catId, &tstamp, &done); err != nil {
+			err = fmt.Errorf("scan next row: %v", err)
+			return
+		}
+		dayOffset := int(tstamp.Sub(weekStart).Hours() / 24)
+		// parents has no cycles as moveCategoryHandler never makes any, but stay safe on a broken db
+		for depth := 0; catId != 0 && depth <= len(parents); depth++ {
+			curDone := hist[catId]
+			curDone[dayOffset] += done
+			hist[catId] = curDone
+			catId = parents[catId]
+		}
+	}
+	return
+}
+
+// activityAccessibleBy reports whether activity actId is in a category of user uid or shared with them
+func activityAccessibleBy(actId int64, uid uint) (accessible bool, err error) {
+	err = db.QueryRow(`SELECT count(*) > 0 FROM activities A
+JOIN categories C ON A.category_id = C.id
+WHERE A.id = ? AND (C.user_id = ? OR C.id IN (`+memberCategoriesQuery+`));`, actId, uid, uid).Scan(&accessible)
+	if err != nil {
+		err = fmt.Errorf("select activity access: %v", err)
+	}
+	return
+}
+
+func doneToday(activityId int64, uid uint) (total int, err error) {
+	return doneSince(activityId, uid, dayBegin(time.Now()))
+}
+
+// doneSince sums pomodoros done by user uid for activity starting from since
+func doneSince(activityId int64, uid uint, since time.Time) (total int, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT H.done
+FROM history H JOIN activities A ON H.activity_id = A.id
+JOIN categories C ON A.category_id = C.id
+WHERE A.id = ? AND H.user_id = ? AND H.tstamp >= ?;`, activityId, uid, since.Unix()*1000)
+	if err != nil {
+		err = fmt.Errorf("select history: %v", err)
+		return
 	}
 	defer rows.Close()
 	for rows.Next() {
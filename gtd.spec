@@ -36,7 +36,6 @@ Go version: %{go_version}
 %define __confdir       /etc/%{name}
 %define __logconfdir    /etc/syslog-ng/conf.d
 %define __repourl       github.com/kilchik/%{name}
-%define __staticdir     /usr/share/%{name}/static
 
 %define gtd_home %{_localstatedir}/cache/gtd
 %define gtd_user gtd
@@ -80,13 +79,11 @@ cd $SRC_ROOT
 %{__mkdir} -p %{buildroot}%{__rundir}
 %{__mkdir} -p %{buildroot}%{__confdir}
 %{__mkdir} -p %{buildroot}%{__logconfdir}
-%{__mkdir} -p %{buildroot}%{__staticdir}
 [ "%{__datadir}" != "" ] && %{__mkdir} -p %{buildroot}%{__datadir}
 
 %{__install} -pD -m 755 build/%{name}  %{buildroot}/%{__bindir}/%{name}
 %{__install} -pD -m 644 gtd.conf  %{buildroot}/%{__confdir}
 %{__install} -pD -m 644 src/%{__repourl}/%{name}_syslog-ng.conf  %{buildroot}/%{__logconfdir}/%{name}.conf
-cp -r src/%{__repourl}/static/*  %{buildroot}/%{__staticdir}
 
 %{__mkdir} -p %{buildroot}/usr/lib/systemd/system/
 %{__install} -pD -m 644 src/%{__repourl}/%{name}.service %{buildroot}/usr/lib/systemd/system/%{name}.service
@@ -104,21 +101,13 @@ systemctl daemon-reload >/dev/null 2>&1 || :
 %postun
 %systemd_postun %{name}.service
 
-%dir /usr/share/%{name}
-
 %files
 %{__bindir}/%{name}
 %attr(0755, gtd, gtd) %dir %{__rundir}
 %attr(0755, gtd, gtd) %dir %{__logdir}
-%attr(0755, gtd, gtd) %dir %{__staticdir}
 %if "%{__datadir}" != ""
 	%attr(0755, gtd, gtd) %dir %{__datadir}
 %endif
-%{__staticdir}/css/bootstrap.css
-%{__staticdir}/css/style.css
-%{__staticdir}/html/index.html
-%{__staticdir}/images/evo.png
-%{__staticdir}/js/script.js
 /usr/lib/systemd/system/%{name}.service
 %{__confdir}/%{name}.conf
 %{__logconfdir}/%{name}.conf
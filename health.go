@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	checkDB           = "db"
+	checkSchema       = "schema"
+	checkAuthProvider = "auth_provider"
+
+	authProviderProbeUrl = "https://graph.facebook.com/"
+	healthCheckTimeout   = 3 * time.Second
+)
+
+var knownHealthChecks = []string{checkDB, checkSchema, checkAuthProvider}
+
+type healthCheck struct {
+	name string
+	// critical checks decide whether the process is healthy enough to keep feeding systemd watchdog;
+	// others (e.g. external dependencies) only affect readiness
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type healthChecker struct {
+	checks []healthCheck
+}
+
+func newHealthChecker(names []string, authProvider *authProviderStatus) (*healthChecker, error) {
+	hc := &healthChecker{}
+	for _, name := range names {
+		switch name {
+		case checkDB:
+			hc.checks = append(hc.checks, healthCheck{name, true, checkDBAlive})
+		case checkSchema:
+			hc.checks = append(hc.checks, healthCheck{name, true, checkSchemaReady})
+		case checkAuthProvider:
+			hc.checks = append(hc.checks, healthCheck{name, false, authProvider.check})
+		default:
+			return nil, fmt.Errorf("unknown health check %q", name)
+		}
+	}
+	return hc, nil
+}
+
+// run executes checks (only critical ones if onlyCritical is set) and reports whether all passed
+func (hc *healthChecker) run(ctx context.Context, onlyCritical bool) (ok bool, results map[string]checkResult) {
+	ok = true
+	results = make(map[string]checkResult)
+	for _, c := range hc.checks {
+		if onlyCritical && !c.critical {
+			continue
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		start := time.Now()
+		err := c.check(checkCtx)
+		cancel()
+
+		res := checkResult{Status: "ok", DurationMs: time.Since(start).Nanoseconds() / 1e6}
+		if err != nil {
+			ok = false
+			res.Status = "fail"
+			res.Error = err.Error()
+		}
+		results[c.name] = res
+	}
+	return
+}
+
+func (hc *healthChecker) readyHandler(w http.ResponseWriter, r *http.Request) {
+	ok, results := hc.run(r.Context(), false)
+	resp := struct {
+		Status string                 `json:"status"`
+		Checks map[string]checkResult `json:"checks"`
+	}{"ok", results}
+	status := http.StatusOK
+	if !ok {
+		logW.Printf(requestLogPrefix(r)+"not ready: %v", results)
+		resp.Status = "fail"
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthResponse(w, status, resp)
+}
+
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealthResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, resp interface{}) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		internalError("encode health response", err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func checkDBAlive(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+func checkSchemaReady(ctx context.Context) error {
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT version FROM schema_version;`).Scan(&version); err != nil {
+		return fmt.Errorf("select schema version: %v", err)
+	}
+	if version != latestSchemaVersion() {
+		return fmt.Errorf("schema version is %d; expected %d", version, latestSchemaVersion())
+	}
+	return nil
+}
+
+// authProviderStatus tracks whether facebook graph api is reachable. Successful authorizations count
+// as proof of reachability so the provider is actively probed only when there were none recently.
+type authProviderStatus struct {
+	ttl   time.Duration
+	httpc *http.Client
+
+	mu        sync.Mutex
+	lastOK    time.Time
+	lastProbe time.Time
+	lastErr   error
+	// probing is set while a probe is in flight; concurrent checks get the previous result meanwhile
+	probing bool
+}
+
+func newAuthProviderStatus(ttl time.Duration) *authProviderStatus {
+	return &authProviderStatus{ttl: ttl, httpc: &http.Client{Timeout: healthCheckTimeout}}
+}
+
+func (s *authProviderStatus) reportOK() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastOK = time.Now()
+}
+
+func (s *authProviderStatus) check(ctx context.Context) error {
+	s.mu.Lock()
+	if time.Since(s.lastOK) < s.ttl {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.probing || time.Since(s.lastProbe) < s.ttl {
+		err := s.lastErr
+		s.mu.Unlock()
+		return err
+	}
+	s.probing = true
+	s.lastProbe = time.Now()
+	s.mu.Unlock()
+
+	// the lock is not held while probing so that reportOK from authorization doesn't wait for it
+	err := s.probe(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probing = false
+	s.lastErr = err
+	if err == nil {
+		s.lastOK = time.Now()
+	}
+	return err
+}
+
+// probe makes a request to the provider; any http response means it is reachable
+func (s *authProviderStatus) probe(ctx context.Context) error {
+	req, err := http.NewRequest("HEAD", authProviderProbeUrl, nil)
+	if err != nil {
+		return fmt.Errorf("prepare probe request: %v", err)
+	}
+	resp, err := s.httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("probe %s: %v", authProviderProbeUrl, err)
+	}
+	resp.Body.Close()
+	return nil
+}
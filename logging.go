@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+// leveledLogger writes messages of one level either as classic text lines or as structured records
+type leveledLogger struct {
+	level   string
+	format  string
+	enabled bool
+	out     io.Writer
+	mu      *sync.Mutex
+	text    *log.Logger
+}
+
+func newLeveledLogger(level, format string, out io.Writer, mu *sync.Mutex, textPrefix string, textFlags int) *leveledLogger {
+	return &leveledLogger{
+		level:   level,
+		format:  format,
+		enabled: out != ioutil.Discard,
+		out:     out,
+		mu:      mu,
+		text:    log.New(out, textPrefix, textFlags),
+	}
+}
+
+func (l *leveledLogger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+}
+
+func (l *leveledLogger) Println(v ...interface{}) {
+	l.output(fmt.Sprintln(v...))
+}
+
+func (l *leveledLogger) Fatalf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (l *leveledLogger) output(msg string) {
+	if !l.enabled {
+		return
+	}
+	msg = redactSecrets(strings.TrimSuffix(msg, "\n"))
+	if l.format == logFormatText {
+		// caller of Printf/Println is two frames up
+		l.text.Output(3, msg)
+		return
+	}
+
+	caller := "???"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	reqId, msg := splitRequestId(msg)
+	fields := [][2]string{
+		{"ts", time.Now().Format(time.RFC3339Nano)},
+		{"level", l.level},
+		{"caller", caller},
+	}
+	if len(reqId) > 0 {
+		fields = append(fields, [2]string{"req_id", reqId})
+	}
+	fields = append(fields, [2]string{"msg", msg})
+
+	var line bytes.Buffer
+	if l.format == logFormatJSON {
+		line.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			k, _ := json.Marshal(f[0])
+			v, _ := json.Marshal(f[1])
+			line.Write(k)
+			line.WriteByte(':')
+			line.Write(v)
+		}
+		line.WriteByte('}')
+	} else {
+		for i, f := range fields {
+			if i > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(f[0] + "=" + logfmtValue(f[1]))
+		}
+	}
+	line.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line.Bytes())
+}
+
+func logfmtValue(v string) string {
+	if len(v) == 0 || strings.ContainsAny(v, " =\"\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)(bearer\s+)[^\s"',;&\]]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(access_token=)[^\s"'&\]]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`("(?:token|access_token|password)"\s*:\s*")[^"]*`), "${1}[REDACTED]"},
+}
+
+// redactSecrets hides auth tokens and passwords that may end up in logged headers, urls or bodies
+func redactSecrets(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// Request ids -->
+
+const requestIdHeader = "X-Request-ID"
+
+type requestIdCtxKey struct{}
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestId assigns every request an id (reusing a sane one from the client or a proxy),
+// returns it in X-Request-ID header and makes it available via requestId
+func withRequestId(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqId := r.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(reqId) {
+			reqId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, reqId)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdCtxKey{}, reqId)))
+	})
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func requestId(r *http.Request) string {
+	reqId, _ := r.Context().Value(requestIdCtxKey{}).(string)
+	return reqId
+}
+
+// requestLogPrefix starts every log message written on behalf of request r; structured formats turn
+// it into the req_id field
+func requestLogPrefix(r *http.Request) string {
+	reqId := requestId(r)
+	if len(reqId) == 0 {
+		return briefDescr(r) + " "
+	}
+	return "rid=" + reqId + " " + briefDescr(r) + " "
+}
+
+func splitRequestId(msg string) (reqId, rest string) {
+	if !strings.HasPrefix(msg, "rid=") {
+		return "", msg
+	}
+	end := strings.IndexByte(msg, ' ')
+	if end < 0 {
+		return msg[len("rid="):], ""
+	}
+	return msg[len("rid="):end], msg[end+1:]
+}
+
+// <-- Request ids
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gtd_http_requests_total",
+		Help: "Number of api requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gtd_http_request_duration_seconds",
+		Help:    "Api request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	metricAuthDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gtd_auth_provider_duration_seconds",
+		Help:    "Latency of auth provider /me calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+	metricAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gtd_auth_failures_total",
+		Help: "Number of failed authorizations by reason.",
+	}, []string{"reason"})
+	metricDBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gtd_db_query_duration_seconds",
+		Help:    "Sql statement execution time by statement kind.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"op"})
+	metricPomodoros = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gtd_pomodoros_logged_total",
+		Help: "Number of pomodoros logged by all users.",
+	})
+	metricCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gtd_objects_created_total",
+		Help: "Number of created users, categories and activities.",
+	}, []string{"kind"})
+	metricWebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gtd_webhook_deliveries_total",
+		Help: "Number of webhook delivery attempts by result: delivered, retry or failed.",
+	}, []string{"result"})
+	metricReminders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gtd_reminders_sent_total",
+		Help: "Number of reminders sent by notifier.",
+	}, []string{"notifier"})
+)
+
+func init() {
+	prometheus.MustRegister(metricRequests, metricRequestDuration, metricAuthDuration, metricAuthFailures,
+		metricDBQueryDuration, metricPomodoros, metricCreated, metricWebhookDeliveries,
+		metricReminders)
+	sql.Register(instrumentedSqliteDriver, instrumentedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// observeRequest records one api request; route is the mux path template so that ids do not blow
+// up label cardinality
+func observeRequest(r *http.Request, statusCode int, start time.Time) {
+	route := "unknown"
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tpl, err := cur.GetPathTemplate(); err == nil {
+			route = tpl
+		}
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	metricRequests.WithLabelValues(route, r.Method, strconv.Itoa(statusCode)).Inc()
+	metricRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler exposes collected metrics; basic auth is required if credentials returns non-empty
+// user
+func metricsHandler(credentials func() (user, password string)) http.Handler {
+	h := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password := credentials()
+		if len(user) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gtd metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Instrumented sqlite driver -->
+
+// instrumentedSqliteDriver is the sql driver name to open db with to get query durations
+const instrumentedSqliteDriver = "sqlite3-instrumented"
+
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+// instrumentedConn times queries run directly by the underlying connection as well as the ones run
+// through Prepare, which are timed by instrumentedStmt
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedStmt{stmt, queryOp(query)}, nil
+}
+
+func (c instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// Ping lets db.PingContext actually reach sqlite; without it database/sql takes the conn for alive
+func (c instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result,
+	error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeDBQuery(queryOp(query), time.Now())
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows,
+	error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeDBQuery(queryOp(query), time.Now())
+	return q.QueryContext(ctx, query, args)
+}
+
+type instrumentedStmt struct {
+	driver.Stmt
+	op string
+}
+
+func (s instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	defer observeDBQuery(s.op, time.Now())
+	return s.Stmt.Exec(args)
+}
+
+func (s instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	defer observeDBQuery(s.op, time.Now())
+	return s.Stmt.Query(args)
+}
+
+func observeDBQuery(op string, start time.Time) {
+	metricDBQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// queryOp returns lowercased leading keyword of query (select, insert, ...)
+func queryOp(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToLower(strings.TrimSuffix(fields[0], ";"))
+}
+
+// <-- Instrumented sqlite driver
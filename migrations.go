@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations[i] upgrades db schema from version i+1 to i+2. Version 1 is the schema made by
+// createTables, so new migrations are only ever appended here.
+var migrations = []func(tx *sql.Tx) error{
+	migrateUserRolesAndInvites,
+	migrateAccountDeletion,
+	migrateTags,
+	migrateCategoryTree,
+	migrateTargetHistory,
+	migrateArchive,
+	migrateTemplates,
+	migrateCategoryMembers,
+	migrateShareLinks,
+	migrateWebhooks,
+	migrateReminders,
+	migrateTemplatePublishing,
+}
+
+func latestSchemaVersion() int {
+	return len(migrations) + 1
+}
+
+func selectSchemaVersion(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (version int, err error) {
+	err = q.QueryRow(`SELECT version FROM schema_version;`).Scan(&version)
+	if err != nil {
+		err = fmt.Errorf("select schema version: %v", err)
+	}
+	return
+}
+
+// migrateDB brings db created by createTables (possibly by an older gtd) up to latest schema version
+func migrateDB() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INT not null);`); err != nil {
+		return fmt.Errorf("create table 'schema_version': %v", err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM schema_version;`).Scan(&n); err != nil {
+		return fmt.Errorf("count schema versions: %v", err)
+	}
+	if n == 0 {
+		// db made before migrations were introduced
+		if _, err := db.Exec(`INSERT INTO schema_version VALUES (1);`); err != nil {
+			return fmt.Errorf("init schema version: %v", err)
+		}
+	}
+
+	version, err := selectSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for ; version < latestSchemaVersion(); version++ {
+		logI.Printf("migrating db schema from version %d to %d", version, version+1)
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin migration tx: %v", err)
+		}
+		if err = migrations[version-1](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate to version %d: %v", version+1, err)
+		}
+		if _, err = tx.Exec(`UPDATE schema_version SET version=?;`, version+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("update schema version: %v", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("commit migration to version %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
+
+func execAll(tx *sql.Tx, queries ...string) error {
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return fmt.Errorf("exec %q: %v", q, err)
+		}
+	}
+	return nil
+}
+
+func migrateUserRolesAndInvites(tx *sql.Tx) error {
+	return execAll(tx, `
+	ALTER TABLE users ADD COLUMN role VARCHAR not null default 'user';
+	`, `
+	ALTER TABLE users ADD COLUMN status VARCHAR not null default 'active';
+	`, `
+	create table invites
+	(
+		id INTEGER PRIMARY KEY,
+		code VARCHAR not null,
+		created TIMESTAMP not null,
+		expires TIMESTAMP not null,
+		created_by INTEGER,
+		used_by INTEGER,
+		used TIMESTAMP,
+		foreign key (created_by) references users (id),
+		foreign key (used_by) references users (id)
+	);
+	`, `
+	create unique index invites_code_uindex
+		on invites (code);
+	`)
+}
+
+func migrateAccountDeletion(tx *sql.Tx) error {
+	return execAll(tx, `
+	ALTER TABLE users ADD COLUMN delete_after TIMESTAMP;
+	`)
+}
+
+func migrateTags(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table tags
+	(
+		id INTEGER PRIMARY KEY,
+		name VARCHAR not null,
+		user_id INTEGER not null,
+		foreign key (user_id) references users (id)
+	);
+	`, `
+	create unique index tags_user_id_name_uindex
+		on tags (user_id, name);
+	`, `
+	create table activity_tags
+	(
+		activity_id INTEGER not null,
+		tag_id INTEGER not null,
+		primary key (activity_id, tag_id),
+		foreign key (activity_id) references activities (id),
+		foreign key (tag_id) references tags (id)
+	);
+	`)
+}
+
+func migrateCategoryTree(tx *sql.Tx) error {
+	return execAll(tx, `
+	ALTER TABLE categories ADD COLUMN parent_id INTEGER references categories (id);
+	`)
+}
+
+// migrateTargetHistory moves npom of activities to versioned targets which also carry schedules; the
+// existing npoms are assumed to be in force since the beginning
+func migrateTargetHistory(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table activity_targets
+	(
+		id INTEGER PRIMARY KEY,
+		activity_id INTEGER not null,
+		effective_from TIMESTAMP not null,
+		npom INT default 0 not null,
+		days VARCHAR,
+		per_week INT default 0 not null,
+		active_from TIMESTAMP,
+		active_until TIMESTAMP,
+		foreign key (activity_id) references activities (id)
+	);
+	`, `
+	create unique index activity_targets_activity_id_effective_from_uindex
+		on activity_targets (activity_id, effective_from);
+	`, `
+	INSERT INTO activity_targets (activity_id, effective_from, npom)
+	SELECT id, 0, IFNULL(npom, 0) FROM activities;
+	`)
+}
+
+func migrateArchive(tx *sql.Tx) error {
+	return execAll(tx, `
+	ALTER TABLE activities ADD COLUMN archived TIMESTAMP;
+	`, `
+	ALTER TABLE categories ADD COLUMN archived TIMESTAMP;
+	`)
+}
+
+func migrateTemplates(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table templates
+	(
+		id INTEGER PRIMARY KEY,
+		name VARCHAR not null,
+		created TIMESTAMP not null,
+		created_by INTEGER,
+		body TEXT not null,
+		foreign key (created_by) references users (id)
+	);
+	`)
+}
+
+// migrateCategoryMembers adds users whom categories are shared with; status is invited until they join
+func migrateCategoryMembers(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table category_members
+	(
+		id INTEGER PRIMARY KEY,
+		category_id INTEGER not null,
+		user_id INTEGER not null,
+		status VARCHAR not null,
+		invited_by INTEGER,
+		joined TIMESTAMP,
+		foreign key (category_id) references categories (id),
+		foreign key (user_id) references users (id)
+	);
+	`, `
+	create unique index category_members_category_id_user_id_uindex
+		on category_members (category_id, user_id);
+	`)
+}
+
+// migrateShareLinks adds tokens giving read-only access to category boards; expires is NULL for links that
+// never expire
+func migrateShareLinks(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table share_links
+	(
+		id INTEGER PRIMARY KEY,
+		token VARCHAR not null,
+		category_id INTEGER not null,
+		created TIMESTAMP not null,
+		created_by INTEGER,
+		expires TIMESTAMP,
+		hide_names BOOLEAN default 0 not null,
+		foreign key (category_id) references categories (id),
+		foreign key (created_by) references users (id)
+	);
+	`, `
+	create unique index share_links_token_uindex
+		on share_links (token);
+	`)
+}
+
+// migrateWebhooks adds webhooks and the queue of their deliveries which is kept as delivery log
+func migrateWebhooks(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table webhooks
+	(
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER not null,
+		url VARCHAR not null,
+		secret VARCHAR not null,
+		events VARCHAR default '' not null,
+		created TIMESTAMP not null,
+		foreign key (user_id) references users (id)
+	);
+	`, `
+	create table webhook_deliveries
+	(
+		id INTEGER PRIMARY KEY,
+		webhook_id INTEGER not null,
+		event VARCHAR not null,
+		payload TEXT not null,
+		status VARCHAR not null,
+		attempts INT default 0 not null,
+		created TIMESTAMP not null,
+		next_attempt TIMESTAMP,
+		delivered TIMESTAMP,
+		last_status INT,
+		last_error VARCHAR,
+		foreign key (webhook_id) references webhooks (id)
+	);
+	`, `
+	create index webhook_deliveries_status_next_attempt_index
+		on webhook_deliveries (status, next_attempt);
+	`)
+}
+
+// migrateReminders adds reminder settings of users and activities they opted out of reminders for
+func migrateReminders(tx *sql.Tx) error {
+	return execAll(tx, `
+	create table reminder_settings
+	(
+		user_id INTEGER PRIMARY KEY,
+		times VARCHAR default '' not null,
+		notifiers VARCHAR default '' not null,
+		email VARCHAR,
+		quiet_from VARCHAR,
+		quiet_until VARCHAR,
+		last_run TIMESTAMP not null,
+		foreign key (user_id) references users (id)
+	);
+	`, `
+	create table reminder_optouts
+	(
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER not null,
+		activity_id INTEGER not null,
+		foreign key (user_id) references users (id),
+		foreign key (activity_id) references activities (id)
+	);
+	`, `
+	create unique index reminder_optouts_user_id_activity_id_uindex
+		on reminder_optouts (user_id, activity_id);
+	`)
+}
+
+// migrateTemplatePublishing makes templates private to their authors until an admin publishes them
+func migrateTemplatePublishing(tx *sql.Tx) error {
+	return execAll(tx, `
+	ALTER TABLE templates ADD COLUMN published BOOLEAN default 0 not null;
+	`)
+}
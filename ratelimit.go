@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route groups that have separate per-user limits
+const (
+	rateGroupRead  = "read"
+	rateGroupWrite = "write"
+	rateGroupDo    = "do"
+)
+
+const rateBucketIdleTTL = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per key. Limit is passed on every call so that config reloads take
+// effect immediately; a bucket holds up to perMin tokens and refills at perMin tokens a minute.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a token for key if there is one; otherwise it returns time until the next token
+func (rl *rateLimiter) allow(key string, perMin int) (ok bool, retryAfter time.Duration) {
+	if perMin <= 0 {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > rateBucketIdleTTL {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > rateBucketIdleTTL {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	capacity := float64(perMin)
+	perSec := capacity / 60
+	b, found := rl.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: capacity, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSec)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSec * float64(time.Second))
+}
+
+// allowIP takes a token of client ip of r; if there is none it responds with 429 and returns false
+func (rl *rateLimiter) allowIP(r *http.Request, conf *configImpl, logPrefix string, w http.ResponseWriter) bool {
+	ip := clientIP(r, conf.params.TrustProxyHeaders)
+	if ok, retryAfter := rl.allow("ip:"+ip, conf.params.RateLimitIPPerMin); !ok {
+		tooManyRequests(logPrefix+"rate limit exceeded for ip "+ip, retryAfter, w)
+		return false
+	}
+	return true
+}
+
+// limitByIP applies per-ip limit to h which serves requests without authentication
+func limitByIP(h http.Handler, conf *liveConfig, limiter *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter.allowIP(r, conf.get(), requestLogPrefix(r), w) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func rateLimitGroup(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, "/history/do") {
+		return rateGroupDo
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return rateGroupRead
+	}
+	return rateGroupWrite
+}
+
+func (c *configImpl) rateLimit(group string) int {
+	switch group {
+	case rateGroupRead:
+		return c.params.RateLimitReadPerMin
+	case rateGroupWrite:
+		return c.params.RateLimitWritePerMin
+	case rateGroupDo:
+		return c.params.RateLimitDoPerMin
+	}
+	return 0
+}
+
+// clientIP returns address of the client; X-Forwarded-For is only believed when gtd runs behind
+// a trusted reverse proxy. Its rightmost entry is the one the proxy appended; the ones before it come
+// from the client and may be forged.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header["X-Forwarded-For"]; len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); len(ip) > 0 {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenRateKey returns limiter key of bearer token of r or "" if there is none; the token is hashed so that
+// it isn't kept in memory longer than the request
+func tokenRateKey(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(token) == 0 || len(token) == len(r.Header.Get("Authorization")) {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:16])
+}
+
+func tooManyRequests(errMsg string, retryAfter time.Duration, w http.ResponseWriter) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	httpError(errMsg, "retry after "+strconv.Itoa(secs)+"s", http.StatusTooManyRequests, w)
+}
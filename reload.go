@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// liveConfig holds the config that is currently in effect and swaps it on reload. Only params tagged
+// with `reload:"true"` are applied at runtime; changes to other ones need a restart.
+type liveConfig struct {
+	layers ConfigLayers
+
+	mu      sync.Mutex   // serializes reloads
+	conf    atomic.Value // *configImpl
+	allowed atomic.Value // map[string]bool
+	admins  atomic.Value // map[string]bool
+	// webhookNets are private networks webhooks may still be delivered to
+	webhookNets atomic.Value // []*net.IPNet
+}
+
+func newLiveConfig(layers ConfigLayers, c *configImpl) *liveConfig {
+	lc := &liveConfig{layers: layers}
+	lc.store(c)
+	return lc
+}
+
+func (lc *liveConfig) store(c *configImpl) {
+	lc.allowed.Store(stringSet(c.params.AllowedFbUids))
+	lc.admins.Store(stringSet(c.params.AdminFbUids))
+	// Validate has already checked the networks
+	nets, _ := parseNets(c.params.WebhookAllowedNets)
+	lc.webhookNets.Store(nets)
+	lc.conf.Store(c)
+}
+
+func stringSet(items []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (lc *liveConfig) webhookAllowedNets() []*net.IPNet {
+	return lc.webhookNets.Load().([]*net.IPNet)
+}
+
+func (lc *liveConfig) get() *configImpl {
+	return lc.conf.Load().(*configImpl)
+}
+
+// access tells whether user with fbId is an admin by config and whether their registration needs
+// neither invite nor approval
+func (lc *liveConfig) access(fbId string) (admin, preApproved bool) {
+	admin = lc.admins.Load().(map[string]bool)[fbId]
+	preApproved = admin || lc.allowed.Load().(map[string]bool)[fbId] || lc.get().params.OpenRegistration
+	return
+}
+
+func (lc *liveConfig) metricsCredentials() (user, password string) {
+	c := lc.get()
+	return c.params.MetricsUser, c.params.MetricsPassword
+}
+
+// reload re-reads config layers; on any error the current config stays in effect
+func (lc *liveConfig) reload() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	next := newConfig()
+	if _, err := InitLayeredConfig(next, lc.layers); err != nil {
+		return err
+	}
+
+	cur := lc.get()
+	applied := &configImpl{params: cur.params}
+	curVal := reflect.ValueOf(&cur.params).Elem()
+	nextVal := reflect.ValueOf(&next.params).Elem()
+	appliedVal := reflect.ValueOf(&applied.params).Elem()
+	changed := 0
+	for i := 0; i < curVal.NumField(); i++ {
+		field := curVal.Type().Field(i)
+		if reflect.DeepEqual(curVal.Field(i).Interface(), nextVal.Field(i).Interface()) {
+			continue
+		}
+		changed++
+		diff := fmt.Sprintf("%s: %s -> %s", field.Tag.Get("toml"),
+			configValueTOML(field, curVal.Field(i)), configValueTOML(field, nextVal.Field(i)))
+		if field.Tag.Get("reload") != "true" {
+			logW.Printf("config reload: %s (ignored until restart)", diff)
+			continue
+		}
+		logI.Printf("config reload: %s", diff)
+		appliedVal.Field(i).Set(nextVal.Field(i))
+	}
+
+	lc.store(applied)
+	logI.Printf("config reloaded from %s; %d params changed", lc.layers.Path, changed)
+	return nil
+}
+
+// watch reloads config on SIGHUP and, if pollInterval is positive, whenever the file mtime changes.
+// Environment and flags are not re-read, they keep overriding the file.
+func (lc *liveConfig) watch(ctx context.Context, pollInterval time.Duration) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+
+	var tick <-chan time.Time
+	var lastMtime time.Time
+	if pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		if info, err := os.Stat(lc.layers.Path); err == nil {
+			lastMtime = info.ModTime()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigc:
+			logI.Println("received SIGHUP; reloading config")
+		case <-tick:
+			info, err := os.Stat(lc.layers.Path)
+			if err != nil || info.ModTime().Equal(lastMtime) {
+				continue
+			}
+			lastMtime = info.ModTime()
+			logI.Println("config file changed; reloading config")
+		}
+		if err := lc.reload(); err != nil {
+			logE.Printf("reload config: %v; keeping previous config", err)
+		}
+	}
+}
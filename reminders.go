@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Reminders nudge user at the times of day they choose about activities whose daily target is not reached
+// yet. Times are in server local time like the rest of day boundaries. A reminder is sent through every
+// notifier user picked unless its time falls within user's quiet hours.
+
+const reminderCheckInterval = time.Minute
+
+// smtpTimeout bounds the whole conversation with smtp server when sending a reminder
+const smtpTimeout = 30 * time.Second
+
+const (
+	// reminderSenders is how many reminders are sent at once
+	reminderSenders = 4
+	// reminderQueueSize limits reminders waiting to be sent; more are dropped
+	reminderQueueSize = 1000
+)
+
+// reminderTimeLayout is the format of reminder times and quiet hours bounds
+const reminderTimeLayout = "15:04"
+
+type reminderSettings struct {
+	// Times of day to check targets at; no times turn reminders off
+	Times     []string `json:"times"`
+	Notifiers []string `json:"notifiers"`
+	// Email is the address email notifier sends to
+	Email string `json:"email,omitempty"`
+	// QuietFrom and QuietUntil bound the time of day reminders are not sent; the range may wrap midnight
+	QuietFrom  string `json:"quiet_from,omitempty"`
+	QuietUntil string `json:"quiet_until,omitempty"`
+	// OptedOut lists activities user doesn't want to be reminded of; it is changed via
+	// /activities/{id}/reminder_optout only
+	OptedOut []int64 `json:"opted_out"`
+}
+
+// validate checks settings and brings times and email to canonical form, e.g. 7:00 becomes 07:00, so that
+// times compare as strings
+func (s *reminderSettings) validate() error {
+	for i, t := range s.Times {
+		at, err := time.Parse(reminderTimeLayout, t)
+		if err != nil {
+			return fmt.Errorf("invalid reminder time %q", t)
+		}
+		s.Times[i] = at.Format(reminderTimeLayout)
+	}
+	if (len(s.QuietFrom) == 0) != (len(s.QuietUntil) == 0) {
+		return fmt.Errorf("quiet_from and quiet_until must be set together")
+	}
+	for _, t := range []*string{&s.QuietFrom, &s.QuietUntil} {
+		if len(*t) == 0 {
+			continue
+		}
+		at, err := time.Parse(reminderTimeLayout, *t)
+		if err != nil {
+			return fmt.Errorf("invalid quiet hours bound %q", *t)
+		}
+		*t = at.Format(reminderTimeLayout)
+	}
+	for _, name := range s.Notifiers {
+		if _, found := notifiers[name]; !found {
+			return fmt.Errorf("unknown notifier %q", name)
+		}
+		if name == "email" {
+			addr, err := mail.ParseAddress(s.Email)
+			if err != nil {
+				return fmt.Errorf("invalid email: %v", err)
+			}
+			// display name and angle brackets have no place in smtp envelope
+			s.Email = addr.Address
+			if len(liveConf.get().params.SMTPAddr) == 0 {
+				return fmt.Errorf("email notifier is not configured on this server")
+			}
+		}
+	}
+	return nil
+}
+
+// quiet reports whether t is within quiet hours
+func (s *reminderSettings) quiet(t time.Time) bool {
+	if len(s.QuietFrom) == 0 {
+		return false
+	}
+	now := t.Format(reminderTimeLayout)
+	if s.QuietFrom <= s.QuietUntil {
+		return s.QuietFrom <= now && now < s.QuietUntil
+	}
+	return s.QuietFrom <= now || now < s.QuietUntil
+}
+
+// reminder is what notifiers send: activities whose daily target is not reached yet
+type reminder struct {
+	uid        uint
+	email      string
+	Time       int64          `json:"time"`
+	Activities []reminderItem `json:"activities"`
+}
+
+type reminderItem struct {
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	Done   int    `json:"done"`
+	Target int    `json:"target"`
+}
+
+// lines describe progress of every activity of reminder
+func (rem *reminder) lines() []string {
+	lines := make([]string, len(rem.Activities))
+	for i, item := range rem.Activities {
+		lines[i] = fmt.Sprintf("%s: %d of %d", item.Name, item.Done, item.Target)
+	}
+	return lines
+}
+
+type notifier interface {
+	notify(rem *reminder) error
+}
+
+// notifiers available to users by name
+var notifiers = map[string]notifier{
+	"log":     logNotifier{},
+	"email":   emailNotifier{},
+	"webhook": webhookNotifier{},
+}
+
+// logNotifier only writes reminders to server log, which is handy to try reminders out
+type logNotifier struct{}
+
+func (logNotifier) notify(rem *reminder) error {
+	logI.Printf("reminder for user %d: %s", rem.uid, strings.Join(rem.lines(), "; "))
+	return nil
+}
+
+// emailNotifier sends reminders via smtp server from config
+type emailNotifier struct{}
+
+func (emailNotifier) notify(rem *reminder) error {
+	params := liveConf.get().params
+	if len(params.SMTPAddr) == 0 {
+		return fmt.Errorf("smtp_addr is not configured")
+	}
+	host, _, err := net.SplitHostPort(params.SMTPAddr)
+	if err != nil {
+		return fmt.Errorf("parse smtp_addr: %v", err)
+	}
+	var auth smtp.Auth
+	if len(params.SMTPUser) > 0 {
+		auth = smtp.PlainAuth("", params.SMTPUser, params.SMTPPassword, host)
+	}
+
+	msg := "From: " + params.SMTPFrom + "\r\n" +
+		"To: " + rem.email + "\r\n" +
+		"Subject: gtd: daily targets not reached yet\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Join(rem.lines(), "\r\n") + "\r\n"
+	if err = sendMail(params.SMTPAddr, host, auth, params.SMTPFrom, rem.email, []byte(msg)); err != nil {
+		return fmt.Errorf("send mail: %v", err)
+	}
+	return nil
+}
+
+// sendMail works like smtp.SendMail but gives up after smtpTimeout, so that an unresponsive smtp server
+// doesn't hold up the scheduler
+func sendMail(addr, host string, auth smtp.Auth, from, to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp server doesn't support AUTH")
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(msg); err != nil {
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// webhookNotifier queues reminder.due event for user's webhooks
+type webhookNotifier struct{}
+
+func (webhookNotifier) notify(rem *reminder) error {
+	if err := queueEvent(rem.uid, eventReminderDue, rem); err != nil {
+		return err
+	}
+	wakeWebhookWorker()
+	return nil
+}
+
+func reminderSettingsHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	settings, err := selectReminderSettings(*user.Id)
+	if err != nil {
+		internalError(logPrefix+"select reminder settings", err, w)
+		return
+	}
+
+	respBody, err := json.Marshal(settings)
+	if err != nil {
+		internalError(logPrefix+"encode reminder settings", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// updateReminderSettingsHandler replaces reminder settings of user; times that have already passed today
+// are not reminded of until tomorrow
+func updateReminderSettingsHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	var settings reminderSettings
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&settings); err != nil {
+		badRequest(logPrefix+"decode reminder settings", err, w)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		badRequest(logPrefix+"invalid reminder settings", err, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"setting reminders at %v", settings.Times)
+
+	if _, err := db.Exec(`INSERT OR REPLACE INTO reminder_settings
+(user_id, times, notifiers, email, quiet_from, quiet_until, last_run) VALUES (?, ?, ?, ?, ?, ?, ?);`,
+		*user.Id, strings.Join(settings.Times, ","), strings.Join(settings.Notifiers, ","), settings.Email,
+		settings.QuietFrom, settings.QuietUntil, time.Now().Unix()*1000); err != nil {
+		internalError(logPrefix+"exec update reminder settings query", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func optOutRemindersHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setReminderOptOut(user, w, r, logPrefix, true)
+}
+
+func optInRemindersHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setReminderOptOut(user, w, r, logPrefix, false)
+}
+
+// setReminderOptOut excludes activity with id from url from reminders of user or includes it back
+func setReminderOptOut(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string, optOut bool) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	actId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	accessible, err := activityAccessibleBy(actId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check activity access", err, w)
+		return
+	}
+	if !accessible {
+		httpError(logPrefix+"activity not found", actId, http.StatusNotFound, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"setting reminder opt-out of activity %d to %v", actId, optOut)
+
+	query := `DELETE FROM reminder_optouts WHERE user_id=? AND activity_id=?;`
+	if optOut {
+		query = `INSERT OR IGNORE INTO reminder_optouts (user_id, activity_id) VALUES (?, ?);`
+	}
+	if _, err = db.Exec(query, *user.Id, actId); err != nil {
+		internalError(logPrefix+"exec update reminder opt-out query", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// selectReminderSettings returns settings of user uid; user who has never set them gets no reminders
+func selectReminderSettings(uid uint) (*reminderSettings, error) {
+	s := &reminderSettings{Times: []string{}, Notifiers: []string{}, OptedOut: []int64{}}
+	var times, names string
+	err := db.QueryRow(`SELECT times, notifiers, IFNULL(email, ''), IFNULL(quiet_from, ''), IFNULL(quiet_until, '')
+FROM reminder_settings WHERE user_id=?;`, uid).Scan(&times, &names, &s.Email, &s.QuietFrom, &s.QuietUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("select reminder settings: %v", err)
+	}
+	if len(times) > 0 {
+		s.Times = strings.Split(times, ",")
+	}
+	if len(names) > 0 {
+		s.Notifiers = strings.Split(names, ",")
+	}
+
+	rows, err := db.Query(`SELECT activity_id FROM reminder_optouts WHERE user_id=? ORDER BY activity_id ASC;`, uid)
+	if err != nil {
+		return nil, fmt.Errorf("select reminder opt-outs: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var actId int64
+		if err = rows.Scan(&actId); err != nil {
+			return nil, fmt.Errorf("scan next row: %v", err)
+		}
+		s.OptedOut = append(s.OptedOut, actId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read reminder opt-out rows: %v", err)
+	}
+	return s, nil
+}
+
+// runReminderScheduler sends reminders whose time has come until ctx is done
+func runReminderScheduler(ctx context.Context) {
+	for i := 0; i < reminderSenders; i++ {
+		go runReminderSender(ctx)
+	}
+	ticker := time.NewTicker(reminderCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := sendDueReminders(time.Now()); err != nil {
+			logE.Printf("send reminders: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendDueReminders reminds every user who has a reminder time today after their last check and not later
+// than now. Times missed on previous days are skipped as done today starts from zero anyway.
+func sendDueReminders(now time.Time) error {
+	rows, err := db.Query(`SELECT user_id, times, last_run FROM reminder_settings WHERE times<>'';`)
+	if err != nil {
+		return fmt.Errorf("select reminder settings: %v", err)
+	}
+	var due []uint
+	for rows.Next() {
+		var uid uint
+		var times string
+		var lastRun time.Time
+		if err = rows.Scan(&uid, &times, &lastRun); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan next row: %v", err)
+		}
+		for _, t := range strings.Split(times, ",") {
+			at, err := time.Parse(reminderTimeLayout, t)
+			if err != nil {
+				continue
+			}
+			today := dayBegin(now)
+			at = time.Date(today.Year(), today.Month(), today.Day(), at.Hour(), at.Minute(), 0, 0, today.Location())
+			if at.After(lastRun) && !at.After(now) {
+				due = append(due, uid)
+				break
+			}
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("read reminder settings rows: %v", err)
+	}
+
+	for _, uid := range due {
+		if err = remind(uid, now); err != nil {
+			logE.Printf("remind user %d: %v", uid, err)
+		}
+		if _, err = db.Exec(`UPDATE reminder_settings SET last_run=? WHERE user_id=?;`, unixMs(now), uid); err != nil {
+			return fmt.Errorf("update last reminder run: %v", err)
+		}
+	}
+	return nil
+}
+
+// remind queues reminder for user uid about activities behind their daily targets for each of user's
+// notifiers
+func remind(uid uint, now time.Time) error {
+	settings, err := selectReminderSettings(uid)
+	if err != nil {
+		return err
+	}
+	if settings.quiet(now) {
+		logD.Printf("reminder for user %d falls within quiet hours", uid)
+		return nil
+	}
+	rem, err := selectReminder(uid, settings.OptedOut, now)
+	if err != nil {
+		return err
+	}
+	if len(rem.Activities) == 0 {
+		return nil
+	}
+	rem.email = settings.Email
+
+	for _, name := range settings.Notifiers {
+		n, found := notifiers[name]
+		if !found {
+			continue
+		}
+		select {
+		case reminderJobs <- reminderJob{rem, name, n}:
+		default:
+			logE.Printf("reminder queue is full; dropping reminder for user %d via %s", uid, name)
+		}
+	}
+	return nil
+}
+
+// reminderJob is a reminder to be sent through one notifier by runReminderSender
+type reminderJob struct {
+	rem      *reminder
+	name     string
+	notifier notifier
+}
+
+// reminderJobs is drained by reminderSenders goroutines, so that a slow notifier such as a stalled smtp server
+// doesn't hold up the scheduler
+var reminderJobs = make(chan reminderJob, reminderQueueSize)
+
+// runReminderSender sends queued reminders until ctx is done
+func runReminderSender(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-reminderJobs:
+			if err := job.notifier.notify(job.rem); err != nil {
+				logE.Printf("notify user %d via %s: %v", job.rem.uid, job.name, err)
+				continue
+			}
+			metricReminders.WithLabelValues(job.name).Inc()
+		}
+	}
+}
+
+// selectReminder collects activities of user uid, shared ones included, having pomodoros left to do today
+func selectReminder(uid uint, optedOut []int64, now time.Time) (*reminder, error) {
+	filter := activityFilter{skipArchived: true}
+	targets, err := selectTargetHistories(uid, filter)
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[int64]bool, len(optedOut))
+	for _, actId := range optedOut {
+		skip[actId] = true
+	}
+
+	where, args := filter.where(uid)
+	rows, err := db.Query(`SELECT A.id, A.name FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE `+where+`
+ORDER BY C.id, vorder ASC;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select activities: %v", err)
+	}
+	var items []reminderItem
+	for rows.Next() {
+		var item reminderItem
+		if err = rows.Scan(&item.Id, &item.Name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan next row: %v", err)
+		}
+		if item.Target = targets[item.Id].at(now).daily(now); item.Target > 0 && !skip[item.Id] {
+			items = append(items, item)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read activity rows: %v", err)
+	}
+
+	rem := &reminder{uid: uid, Time: unixMs(now), Activities: []reminderItem{}}
+	for _, item := range items {
+		if item.Done, err = doneToday(item.Id, uid); err != nil {
+			return nil, err
+		}
+		if item.Done < item.Target {
+			rem.Activities = append(rem.Activities, item)
+		}
+	}
+	return rem, nil
+}
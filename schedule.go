@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// schedule describes when pomodoros of an activity are planned if the same npom every day doesn't fit
+type schedule struct {
+	// Days holds targets for each weekday starting with Sunday; nil means npom every day
+	Days *[7]int `json:"days,omitempty"`
+	// PerWeek is a target for the whole week (Monday to Sunday) no matter which days it is done on
+	PerWeek int `json:"per_week,omitempty"`
+	// ActiveFrom and ActiveUntil are the first and the last days activity is planned for; 0 means
+	// unbounded
+	ActiveFrom  int64 `json:"active_from,omitempty"`
+	ActiveUntil int64 `json:"active_until,omitempty"`
+}
+
+func (s *schedule) validate() error {
+	if s.Days != nil && s.PerWeek != 0 {
+		return fmt.Errorf("days and per_week targets are mutually exclusive")
+	}
+	if s.PerWeek < 0 {
+		return fmt.Errorf("negative per_week target")
+	}
+	if s.Days != nil {
+		for _, n := range s.Days {
+			if n < 0 {
+				return fmt.Errorf("negative day target")
+			}
+		}
+	}
+	if s.ActiveFrom < 0 || s.ActiveUntil < 0 {
+		return fmt.Errorf("negative active date")
+	}
+	if s.ActiveFrom != 0 && s.ActiveUntil != 0 && s.ActiveUntil < s.ActiveFrom {
+		return fmt.Errorf("active_until is before active_from")
+	}
+	return nil
+}
+
+// active reports whether day is within active date range of schedule
+func (s *schedule) active(day time.Time) bool {
+	day = dayBegin(day)
+	if s.ActiveFrom != 0 && day.Before(dayBegin(msTime(s.ActiveFrom))) {
+		return false
+	}
+	if s.ActiveUntil != 0 && day.After(dayBegin(msTime(s.ActiveUntil))) {
+		return false
+	}
+	return true
+}
+
+// formatDays encodes per-weekday targets the way they are stored in db
+func formatDays(days [7]int) string {
+	parts := make([]string, len(days))
+	for i, n := range days {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseDays(s string) (days [7]int, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != len(days) {
+		err = fmt.Errorf("expected %d day targets, got %q", len(days), s)
+		return
+	}
+	for i, p := range parts {
+		if days[i], err = strconv.Atoi(p); err != nil {
+			err = fmt.Errorf("parse day targets %q: %v", s, err)
+			return
+		}
+	}
+	return
+}
+
+// activityTarget is what is planned for an activity: npom every day unless it has a schedule
+type activityTarget struct {
+	npom  int
+	sched *schedule
+}
+
+// daily returns number of pomodoros planned for day; it is 0 for activities with weekly targets as
+// those are not bound to particular days
+func (t activityTarget) daily(day time.Time) int {
+	if t.sched == nil {
+		return t.npom
+	}
+	if !t.sched.active(day) || t.sched.PerWeek != 0 {
+		return 0
+	}
+	if t.sched.Days != nil {
+		return t.sched.Days[day.Weekday()]
+	}
+	return t.npom
+}
+
+// weekly returns number of pomodoros planned for the week containing day if activity has a weekly target
+func (t activityTarget) weekly(day time.Time) (n int, ok bool) {
+	if t.sched == nil || t.sched.PerWeek == 0 {
+		return 0, false
+	}
+	if !t.sched.active(day) {
+		return 0, true
+	}
+	return t.sched.PerWeek, true
+}
+
+// dayBegin returns midnight starting the day of t
+func dayBegin(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// weekBegin returns midnight starting Monday of the week of t
+func weekBegin(t time.Time) time.Time {
+	d := dayBegin(t)
+	return d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+}
+
+// msTime converts milliseconds since epoch to local time
+func msTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// setScheduleHandler replaces schedule of activity starting from today; past days keep the target that
+// was in force then
+func setScheduleHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	actId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var sched schedule
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&sched); err != nil {
+		badRequest(logPrefix+"decode schedule", err, w)
+		return
+	}
+	if err := sched.validate(); err != nil {
+		badRequest(logPrefix+"invalid schedule", err, w)
+		return
+	}
+
+	owned, err := activityOwnedBy(actId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check activity owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"activity not found", actId, http.StatusNotFound, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"setting schedule of activity %d", actId)
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	// the version in force is read and replaced in one tx so that concurrent edits don't overwrite each other
+	target, err := selectActivityTarget(tx, actId)
+	if err != nil {
+		internalError(logPrefix+"select activity target", err, w)
+		return
+	}
+	if sched.ActiveFrom != 0 {
+		sched.ActiveFrom = unixMs(dayBegin(msTime(sched.ActiveFrom)))
+	}
+	if sched.ActiveUntil != 0 {
+		sched.ActiveUntil = unixMs(dayBegin(msTime(sched.ActiveUntil)))
+	}
+	target.sched = &sched
+	if err = saveTarget(tx, actId, target); err != nil {
+		internalError(logPrefix+"save activity target", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeScheduleHandler makes activity planned for npom pomodoros every day again starting from today
+func removeScheduleHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	actId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	owned, err := activityOwnedBy(actId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check activity owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"activity not found", actId, http.StatusNotFound, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"removing schedule of activity %d", actId)
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	target, err := selectActivityTarget(tx, actId)
+	if err != nil {
+		internalError(logPrefix+"select activity target", err, w)
+		return
+	}
+	target.sched = nil
+	if err = saveTarget(tx, actId, target); err != nil {
+		internalError(logPrefix+"save activity target", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// historyTargetsHandler responds with targets in force during the days of week history for the same
+// activities as historyHandler
+func historyTargetsHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	filter, err := parseActivityFilter(r)
+	if err != nil {
+		badRequest(logPrefix+"invalid query params", err, w)
+		return
+	}
+	filter.subcats = true
+	targets, err := selectTargetHistories(*user.Id, filter)
+	if err != nil {
+		internalError(logPrefix+"select activity targets", err, w)
+		return
+	}
+
+	weekStart := histWeekStart()
+	h := make(map[int64]histTarget, len(targets))
+	for actId, t := range targets {
+		h[actId] = t.hist(weekStart)
+	}
+
+	respBody, err := json.Marshal(h)
+	if err != nil {
+		internalError(logPrefix+"encode history targets", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs servers until any listener fails or a termination signal arrives; in the latter case
+// in-flight requests are given shutdownTimeout to complete. Servers with TLSConfig set serve https.
+// ready is called once all servers listen on their ports.
+func serve(shutdownTimeout time.Duration, ready func(), servers ...*http.Server) error {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigc)
+
+	listeners := make([]net.Listener, 0, len(servers))
+	for _, srv := range servers {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	errc := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			errc <- fmt.Errorf("listen %s: %v", srv.Addr, err)
+		}(srv, listeners[i])
+	}
+	ready()
+
+	var serveErr error
+	select {
+	case serveErr = <-errc:
+		logE.Printf("%v; shutting down", serveErr)
+	case sig := <-sigc:
+		logI.Printf("received %v; shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && serveErr == nil {
+			serveErr = fmt.Errorf("drain requests on %s: %v", srv.Addr, err)
+		}
+	}
+	return serveErr
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Shared categories: owner invites other users, and once they join they see the category with its activities
+// and log their own history against them. Subcategories of a shared category are not shared.
+
+const (
+	memberInvited = "invited"
+	memberActive  = "active"
+)
+
+// memberCategoriesQuery selects ids of categories shared with a user who joined them; arg is user id
+const memberCategoriesQuery = `SELECT category_id FROM category_members WHERE user_id = ? AND status = 'active'`
+
+type memberInfo struct {
+	UserId int64  `json:"user_id"`
+	Name   string `json:"name"`
+	// Status is owner for the owner of category, otherwise membership status
+	Status string `json:"status"`
+	Joined int64  `json:"joined,omitempty"`
+}
+
+func membersListHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	accessible, err := categoryAccessibleBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category access", err, w)
+		return
+	}
+	if !accessible {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	members, err := selectMembers(catId, false)
+	if err != nil {
+		internalError(logPrefix+"select members", err, w)
+		return
+	}
+
+	respBody, err := json.Marshal(members)
+	if err != nil {
+		internalError(logPrefix+"encode members list", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// inviteMemberHandler lets owner of category invite another user identified by user_id or fb_id
+func inviteMemberHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var inviteRequest struct {
+		UserId int64  `json:"user_id"`
+		FbId   string `json:"fb_id"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&inviteRequest); err != nil {
+		badRequest(logPrefix+"decode invite member request body", err, w)
+		return
+	}
+
+	owned, err := categoryOwnedBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	var memberId int64
+	err = db.QueryRow(`SELECT id FROM users WHERE (id=? OR fb_id=?) AND status=?;`,
+		inviteRequest.UserId, inviteRequest.FbId, userActive).Scan(&memberId)
+	if err == sql.ErrNoRows {
+		httpError(logPrefix+"user not found", inviteRequest, http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		internalError(logPrefix+"select invited user", err, w)
+		return
+	}
+	if memberId == int64(*user.Id) {
+		badRequest(logPrefix+"owner cannot be invited to own category", nil, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"inviting user %d to category %d", memberId, catId)
+
+	res, err := db.Exec(`INSERT OR IGNORE INTO category_members (category_id, user_id, status, invited_by)
+VALUES (?, ?, ?, ?);`, catId, memberId, memberInvited, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec insert member query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"user is already invited", memberId, http.StatusConflict, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"user_id":%d}`, memberId))
+}
+
+// joinCategoryHandler accepts invitation to a shared category
+func joinCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	res, err := db.Exec(`UPDATE category_members SET status=?, joined=? WHERE category_id=? AND user_id=?;`,
+		memberActive, time.Now().Unix()*1000, catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec join category query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"no invitation to category", catId, http.StatusNotFound, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeMemberHandler lets owner remove a member of category and a member leave it or decline invitation.
+// History logged by the member is kept.
+func removeMemberHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+	memberId, err := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	if memberId != int64(*user.Id) {
+		owned, err := categoryOwnedBy(catId, *user.Id)
+		if err != nil {
+			internalError(logPrefix+"check category owner", err, w)
+			return
+		}
+		if !owned {
+			httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+			return
+		}
+	}
+
+	logD.Printf(logPrefix+"removing user %d from category %d", memberId, catId)
+
+	res, err := db.Exec(`DELETE FROM category_members WHERE category_id=? AND user_id=?;`, catId, memberId)
+	if err != nil {
+		internalError(logPrefix+"exec remove member query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"member not found", memberId, http.StatusNotFound, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// sharedCategoriesHandler lists categories user was invited to or joined
+func sharedCategoriesHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	rows, err := db.Query(`SELECT C.id, C.name, C.user_id, IFNULL(U.name, ''), M.status
+FROM category_members M JOIN categories C ON M.category_id = C.id JOIN users U ON C.user_id = U.id
+WHERE M.user_id=? ORDER BY C.id ASC;`, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"select shared categories", err, w)
+		return
+	}
+	defer rows.Close()
+
+	type sharedInfo struct {
+		Id        int64  `json:"id"`
+		Name      string `json:"name"`
+		OwnerId   int64  `json:"owner_id"`
+		OwnerName string `json:"owner_name"`
+		Status    string `json:"status"`
+	}
+	shared := []sharedInfo{}
+	for rows.Next() {
+		var sh sharedInfo
+		if err = rows.Scan(&sh.Id, &sh.Name, &sh.OwnerId, &sh.OwnerName, &sh.Status); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		shared = append(shared, sh)
+	}
+
+	respBody, err := json.Marshal(shared)
+	if err != nil {
+		internalError(logPrefix+"encode shared categories", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// membersHistoryHandler responds with week history of category broken down by owner and active members
+func membersHistoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(r.URL.Query().Get("cat_id"), 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"not a num cat_id query param", err, w)
+		return
+	}
+
+	accessible, err := categoryAccessibleBy(catId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check category access", err, w)
+		return
+	}
+	if !accessible {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+
+	members, err := selectMembers(catId, true)
+	if err != nil {
+		internalError(logPrefix+"select members", err, w)
+		return
+	}
+	type memberHist struct {
+		memberInfo
+		History map[int64][7]int `json:"history"`
+	}
+	var resp struct {
+		Members []memberHist `json:"members"`
+	}
+	resp.Members = []memberHist{}
+	for _, m := range members {
+		// a member sees shared category only, without owner's private subcategories
+		h, err := selectWeekHist(uint(m.UserId), activityFilter{catId: catId})
+		if err != nil {
+			internalError(logPrefix+"select week hist", err, w)
+			return
+		}
+		resp.Members = append(resp.Members, memberHist{m, h})
+	}
+
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		internalError(logPrefix+"encode members history", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// categoryAccessibleBy reports whether category catId belongs to user uid or is shared with them
+func categoryAccessibleBy(catId int64, uid uint) (accessible bool, err error) {
+	err = db.QueryRow(`SELECT count(*) > 0 FROM categories
+WHERE id = ? AND (user_id = ? OR id IN (`+memberCategoriesQuery+`));`, catId, uid, uid).Scan(&accessible)
+	if err != nil {
+		err = fmt.Errorf("select category access: %v", err)
+	}
+	return
+}
+
+// selectMembers returns owner of category catId followed by members, only the ones who joined if activeOnly
+func selectMembers(catId int64, activeOnly bool) (members []memberInfo, err error) {
+	var owner memberInfo
+	err = db.QueryRow(`SELECT U.id, IFNULL(U.name, '') FROM categories C JOIN users U ON C.user_id = U.id
+WHERE C.id = ?;`, catId).Scan(&owner.UserId, &owner.Name)
+	if err != nil {
+		err = fmt.Errorf("select category owner: %v", err)
+		return
+	}
+	owner.Status = "owner"
+	members = append(members, owner)
+
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT U.id, IFNULL(U.name, ''), M.status, IFNULL(M.joined, 0)
+FROM category_members M JOIN users U ON M.user_id = U.id
+WHERE M.category_id = ? AND (? = 0 OR M.status = 'active') ORDER BY U.id ASC;`, catId, activeOnly)
+	if err != nil {
+		err = fmt.Errorf("select members: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m memberInfo
+		if err = rows.Scan(&m.UserId, &m.Name, &m.Status, &m.Joined); err != nil {
+			err = fmt.Errorf("scan next row: %v", err)
+			return
+		}
+		members = append(members, m)
+	}
+	return
+}
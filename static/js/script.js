@@ -41,7 +41,7 @@ function generateAddActivity(catId, nameInput, pomsInput) {
     }
 }
 
-function appendCatView(showId, catId, acts, hist) {
+function appendCatView(showId, catId, acts, hist, targets) {
     logD(`appending category view: show=${showId},id=${catId}, acts=${JSON.stringify(acts)}, hist=${JSON.stringify(hist)}`);
 
     let catDiv = document.createElement("div");
@@ -53,7 +53,7 @@ function appendCatView(showId, catId, acts, hist) {
     }
     catDiv.setAttribute("class", catDivCls);
 
-    let catTable = generateCatHistTable(catId, acts, hist);
+    let catTable = generateCatHistTable(catId, acts, hist, targets);
     if (catTable) {
         catDiv.appendChild(catTable);
     }
@@ -74,7 +74,7 @@ async function renderAuthorized() {
     // enable navbar item
     $("#categoriesList").removeClass("disabled");
 
-    let cats = await fetchCategories();
+    let cats = flattenCategories(await fetchCategories());
     logD("categories: "+JSON.stringify(cats));
     if (cats) {
         showCategoriesNavigation(cats);
@@ -84,8 +84,9 @@ async function renderAuthorized() {
             logD("activities: "+JSON.stringify(actsObj.activities));
             let hist = await fetchHistory(cats[ci].id);
             logD("history: "+JSON.stringify(hist));
+            let targets = await fetchHistoryTargets(cats[ci].id);
 
-            appendCatView(ci, cats[ci].id, actsObj.activities, hist);
+            appendCatView(ci, cats[ci].id, actsObj.activities, hist, targets);
         }
     }
 
@@ -93,7 +94,7 @@ async function renderAuthorized() {
     content.show();
 }
 
-function generateCatHistTable(catId, actList, hist) {
+function generateCatHistTable(catId, actList, hist, targets) {
     logD(`generating history table for category ${catId}, with actions ${JSON.stringify(actList)} and history ${JSON.stringify(hist)}`);
     let table = document.createElement("table");
     table.setAttribute("class", "table table-bordered table-hover");
@@ -114,7 +115,7 @@ function generateCatHistTable(catId, actList, hist) {
 
     let tableBody = document.createElement("tbody");
     $.each(actList, function(_, actItem) {
-        let r = createActRow(actItem.id, actItem.name, actItem.npom, hist[actItem.id]);
+        let r = createActRow(actItem.id, actItem.name, actItem.npom, hist[actItem.id], targets ? targets[actItem.id] : null);
         tableBody.appendChild(r);
     });
 
@@ -155,6 +156,20 @@ function renderNotAuthorized() {
     content.show();
 }
 
+// flattenCategories turns category tree into a list where subcategory names are prefixed with parents' ones
+function flattenCategories(roots, prefix = "") {
+    if (!roots) {
+        return roots;
+    }
+    let cats = [];
+    roots.forEach(function (cat) {
+        let name = prefix + cat.name;
+        cats.push({"id": cat.id, "name": name});
+        cats = cats.concat(flattenCategories(cat.children, name + " / "));
+    });
+    return cats;
+}
+
 async function fetchCategories() {
     logD("fetching categories");
     let token = localStorage.getItem("access-token");
@@ -165,7 +180,7 @@ async function fetchCategories() {
 
     return $.when($.ajax({
         type: "GET",
-        url: "categories/",
+        url: "api/v1/categories/",
         dataType: "json",
         beforeSend: function (xhr) {
             let tokenHdr = "Bearer " + token;
@@ -184,7 +199,26 @@ async function fetchActivities(catId) {
 
     return $.when($.ajax({
         type: "GET",
-        url: "activities?cat_id="+catId,
+        url: "api/v1/activities?cat_id="+catId,
+        dataType: "json",
+        beforeSend: function (xhr) {
+            let tokenHdr = "Bearer " + token;
+            xhr.setRequestHeader('Authorization', tokenHdr);
+        },
+    }));
+}
+
+async function fetchHistoryTargets(catId) {
+    logD("fetching history targets");
+    let token = localStorage.getItem('access-token');
+    if (!token) {
+        //todo: handle error
+        return
+    }
+
+    return $.when($.ajax({
+        type: "GET",
+        url: "api/v1/history/targets?cat_id="+catId,
         dataType: "json",
         beforeSend: function (xhr) {
             let tokenHdr = "Bearer " + token;
@@ -203,7 +237,7 @@ async function fetchHistory(catId) {
 
     return $.when($.ajax({
         type: "GET",
-        url: "history?cat_id="+catId,
+        url: "api/v1/history?cat_id="+catId,
         dataType: "json",
         beforeSend: function (xhr) {
             let tokenHdr = "Bearer " + token;
@@ -235,18 +269,24 @@ function checkLoginState(refresh) {
         let tokenTimeout = response.authResponse.expiresIn;
 
         logD("tokenTimeout: " + tokenTimeout);
+        let newUserRequest = Object.assign({}, response);
+        let inviteCode = new URLSearchParams(window.location.search).get("invite");
+        if (inviteCode) {
+            newUserRequest.invite_code = inviteCode;
+        }
         $.ajax({
             type: "POST",
-            url: "users/new",
+            url: "api/v1/users/new",
             dataType: "json",
-            data: JSON.stringify(response),
+            data: JSON.stringify(newUserRequest),
             beforeSend: function (xhr) {
                 let tokenHdr = "Bearer " + token;
                 xhr.setRequestHeader('Authorization', tokenHdr);
             },
             complete: function (xhr) {
                 logD("users/new status: " + xhr.status);
-                if (xhr.status === 403) {
+                // 202 means registered but awaiting approval by admin
+                if (xhr.status === 403 || xhr.status === 202) {
                     let naalert = $("#notallowed-alert");
                     naalert.show();
                 } else {
@@ -286,7 +326,7 @@ function doPomodoro(newVal, actId) {
     let token = localStorage.getItem("access-token");
     $.ajax({
         type: "POST",
-        url: "history/do",
+        url: "api/v1/history/do",
         dataType: "json",
         data: JSON.stringify(data),
         beforeSend: function (xhr) {
@@ -300,7 +340,10 @@ function doPomodoro(newVal, actId) {
 function cellClass(real, actPoms) {
     logD(`calc cell class for real=${real}, actPoms=${actPoms}`);
     let cls = "danger";
-    if (real >= actPoms) {
+    if (actPoms === 0 && real === 0) {
+        // nothing planned for the day
+        cls = "";
+    } else if (real >= actPoms) {
         cls = "success";
     } else if (real > 0) {
         cls = "info";
@@ -312,24 +355,31 @@ function passIdToModal(actId) {
     $("#done-editing-button").attr("data-id", actId);
 }
 
-function createActRow(actId, actName, actPoms, actHist) {
+// createActRow makes table row with week history of activity; actTargets holds scheduled targets for each
+// day, without them actPoms is the target every day
+function createActRow(actId, actName, actPoms, actHist, actTargets) {
     logD(`creating row for action with id=${actId}, name=${actName}, poms=${actPoms}, hist=${actHist}`);
 
+    let dayTarget = function (i) {
+        return actTargets ? actTargets.days[i] : actPoms;
+    };
+    let goal = actTargets && actTargets.per_week ? `${actTargets.per_week}/week` : actPoms;
+
     let row = document.createElement("tr");
     row.setAttribute("data-id", actId);
-    row.innerHTML += `<th scope="row">${actName} (${actPoms})</th>`;
+    row.innerHTML += `<th scope="row">${actName} (${goal})</th>`;
     for (i = 0; i < 6; ++i) {
         let real = 0;
         if (actHist) {
             real = actHist[i];
         }
-        row.innerHTML += `<td class="${cellClass(real, actPoms)}">${real}</td>`;
+        row.innerHTML += `<td class="${cellClass(real, dayTarget(i))}">${real}</td>`;
     }
 
     let todayVal = parseInt(actHist ? actHist[6] : '0');
     let addButton = `<button type="button" class="btn btn-default btn-xs add-pom-button" onclick="doPomodoro(${todayVal}+1, ${actId})"><span class="glyphicon glyphicon-plus"></span></button>`;
 
-    row.innerHTML += `<td class="${cellClass(todayVal, actPoms)}"><div id="cell${actId}" class="pull-left">${todayVal}</div><div class="pull-right">${addButton}</div></td>`;
+    row.innerHTML += `<td class="${cellClass(todayVal, dayTarget(6))}"><div id="cell${actId}" class="pull-left">${todayVal}</div><div class="pull-right">${addButton}</div></td>`;
 
     let editGlyph = `<span class="glyphicon glyphicon-edit"></span>`;
     let editButton = `<button type="button" class="btn btn-default btn-xs edit-act-button" style="visibility: hidden" data-toggle="modal" onclick="passIdToModal(${actId})" data-target="#edit-act-dlg">${editGlyph}</button>`;
@@ -390,7 +440,7 @@ async function finalizeEditing() {
                 case EditActionType.Remove:
                     await $.when($.ajax({
                         type: "DELETE",
-                        url: "activities/" + a.id,
+                        url: "api/v1/activities/" + a.id,
                         beforeSend: function (xhr) {
                             let tokenHdr = "Bearer " + token;
                             xhr.setRequestHeader('Authorization', tokenHdr);
@@ -400,7 +450,7 @@ async function finalizeEditing() {
                 case EditActionType.Update:
                     await $.when($.ajax({
                         type: "PUT",
-                        url: "activities/" + a.id,
+                        url: "api/v1/activities/" + a.id,
                         data: `{"name":"${a.name}", "npom":${a.npom}}`,
                         beforeSend: function (xhr) {
                             let tokenHdr = "Bearer " + token;
@@ -449,7 +499,7 @@ function createCategory() {
     let token = localStorage.getItem("access-token");
     $.ajax({
         type: "POST",
-        url: "categories/new",
+        url: "api/v1/categories/new",
         dataType: "json",
         data: `{"name":"${name}"}`,
         beforeSend: function (xhr) {
@@ -487,7 +537,7 @@ function removeCategory() {
     let catId = $("#catPills").find(".active").attr("data-id");
     $.ajax({
         type: "DELETE",
-        url: "categories/"+catId,
+        url: "api/v1/categories/"+catId,
         beforeSend: function (xhr) {
             let tokenHdr = "Bearer " + token;
             xhr.setRequestHeader('Authorization', tokenHdr);
@@ -512,7 +562,7 @@ function renameCategory() {
     let newName = $("#renameCategoryInput").val();
     $.ajax({
         type: "PUT",
-        url: "categories/"+catId,
+        url: "api/v1/categories/"+catId,
         data: `{"name":"${newName}"}`,
         beforeSend: function (xhr) {
             let tokenHdr = "Bearer " + token;
@@ -571,7 +621,7 @@ function addActivity(catId, actName, actPoms) {
     let token = localStorage.getItem("access-token");
     $.ajax({
         type: "POST",
-        url: "activities/new",
+        url: "api/v1/activities/new",
         dataType: "json",
         data: JSON.stringify({
                 "name": actName,
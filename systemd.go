@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to systemd if the service runs with NOTIFY_SOCKET set; it is a no-op otherwise
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if len(socketPath) == 0 {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write to notify socket: %v", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns how often systemd expects watchdog pings or 0 if watchdog is disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog reports readiness to systemd and then keeps pinging the watchdog while critical health
+// checks pass, so that systemd restarts the service once it gets stuck
+func runWatchdog(ctx context.Context, hc *healthChecker) {
+	if err := sdNotify("READY=1"); err != nil {
+		logW.Printf("notify systemd: %v", err)
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logI.Printf("systemd watchdog enabled; interval %v", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if ok, results := hc.run(ctx, true); !ok {
+			logE.Printf("health checks failed; skipping watchdog ping: %v", results)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logW.Printf("ping systemd watchdog: %v", err)
+		}
+	}
+}
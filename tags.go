@@ -0,0 +1,385 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const maxTagNameLen = 64
+
+// normTagName trims tag name and checks that it is usable
+func normTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return "", fmt.Errorf("empty tag name")
+	}
+	if len(name) > maxTagNameLen {
+		return "", fmt.Errorf("tag name longer than %d bytes", maxTagNameLen)
+	}
+	return name, nil
+}
+
+// activityFilter selects activities of a category, with a tag or both
+type activityFilter struct {
+	catId int64
+	// subcats extends category filter to its descendants
+	subcats bool
+	tag     string
+	// skipArchived leaves out archived activities and activities of archived categories' subtrees
+	skipArchived bool
+}
+
+// parseActivityFilter reads filter from cat_id and tag query params; at least one of them is required
+func parseActivityFilter(r *http.Request) (filter activityFilter, err error) {
+	query := r.URL.Query()
+	if catIdStr := query.Get("cat_id"); len(catIdStr) != 0 {
+		if filter.catId, err = strconv.ParseInt(catIdStr, 10, 64); err != nil {
+			err = fmt.Errorf("not a num cat_id query param: %v", err)
+			return
+		}
+	}
+	filter.tag = strings.TrimSpace(query.Get("tag"))
+	if filter.catId == 0 && len(filter.tag) == 0 {
+		err = fmt.Errorf("either cat_id or tag query param is required")
+	}
+	return
+}
+
+// where returns sql condition matching filtered activities of user uid in a query joining
+// activities A and categories C. Besides own categories user has access to the ones shared with them.
+func (f activityFilter) where(uid uint) (cond string, args []interface{}) {
+	cond = "(C.user_id = ? OR C.id IN (" + memberCategoriesQuery + "))"
+	args = append(args, uid, uid)
+	if f.catId != 0 && f.subcats {
+		// subcategories of a shared category stay private to its owner
+		cond += " AND (C.id = ? OR C.id IN (" + categorySubtreeQuery + "))"
+		args = append(args, f.catId, f.catId, uid)
+	} else if f.catId != 0 {
+		cond += " AND C.id = ?"
+		args = append(args, f.catId)
+	}
+	if len(f.tag) != 0 {
+		cond += ` AND A.id IN (SELECT AT.activity_id FROM activity_tags AT JOIN tags T ON AT.tag_id = T.id
+WHERE T.user_id = ? AND T.name = ?)`
+		args = append(args, uid, f.tag)
+	}
+	if f.skipArchived {
+		cond += " AND A.archived IS NULL AND C.id NOT IN (" + archivedCategoriesQuery + ")"
+		args = append(args, uid, uid)
+	}
+	return
+}
+
+func tagsListHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	rows, err := db.Query(`SELECT T.id, T.name,
+(SELECT count(*) FROM activity_tags AT WHERE AT.tag_id = T.id)
+FROM tags T WHERE T.user_id=? ORDER BY T.name ASC;`, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"select tags list", err, w)
+		return
+	}
+	defer rows.Close()
+
+	type tagInfo struct {
+		Id            int64  `json:"id"`
+		Name          string `json:"name"`
+		NumActivities int    `json:"num_activities"`
+	}
+	tags := []tagInfo{}
+	for rows.Next() {
+		var t tagInfo
+		if err = rows.Scan(&t.Id, &t.Name, &t.NumActivities); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		tags = append(tags, t)
+	}
+
+	respBody, err := json.Marshal(tags)
+	if err != nil {
+		internalError(logPrefix+"encode tags list", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func newTagHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	var newTagRequest struct {
+		Name string `json:"name"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&newTagRequest); err != nil {
+		badRequest(logPrefix+"decode new tag", err, w)
+		return
+	}
+	name, err := normTagName(newTagRequest.Name)
+	if err != nil {
+		badRequest(logPrefix+"invalid tag name", err, w)
+		return
+	}
+
+	tagId, err := selectTag(db, *user.Id, name)
+	if err != nil {
+		internalError(logPrefix+"select tag", err, w)
+		return
+	}
+	if tagId != 0 {
+		httpError(logPrefix+"tag already exists", name, http.StatusConflict, w)
+		return
+	}
+
+	execRes, err := db.Exec(`INSERT INTO tags (name, user_id) VALUES (?, ?);`, name, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec insert new tag query", err, w)
+		return
+	}
+	newId, err := execRes.LastInsertId()
+	if err != nil {
+		internalError(logPrefix+"get last insert id", err, w)
+		return
+	}
+	metricCreated.WithLabelValues("tag").Inc()
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d}`, newId))
+}
+
+func updateTagHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	tagId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var renameTagRequest struct {
+		Name string `json:"name"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&renameTagRequest); err != nil {
+		badRequest(logPrefix+"decode rename tag request body", err, w)
+		return
+	}
+	name, err := normTagName(renameTagRequest.Name)
+	if err != nil {
+		badRequest(logPrefix+"invalid tag name", err, w)
+		return
+	}
+
+	sameNameId, err := selectTag(db, *user.Id, name)
+	if err != nil {
+		internalError(logPrefix+"select tag", err, w)
+		return
+	}
+	if sameNameId != 0 && sameNameId != tagId {
+		httpError(logPrefix+"tag already exists", name, http.StatusConflict, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"renaming tag %d", tagId)
+
+	res, err := db.Exec(`UPDATE tags SET name=? WHERE id=? AND user_id=?;`, name, tagId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec rename tag query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"tag not found", tagId, http.StatusNotFound, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func removeTagHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	tagId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"removing tag %d", tagId)
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM tags WHERE id=? AND user_id=?;`, tagId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec remove tag query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"tag not found", tagId, http.StatusNotFound, w)
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM activity_tags WHERE tag_id=?;`, tagId); err != nil {
+		internalError(logPrefix+"exec untag activities query", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// setActivityTagsHandler replaces the set of tags of an activity; tags are referenced by name and
+// created on the fly if user has none with such name yet
+func setActivityTagsHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	actId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var setTagsRequest struct {
+		Tags []string `json:"tags"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&setTagsRequest); err != nil {
+		badRequest(logPrefix+"decode set tags request body", err, w)
+		return
+	}
+	names := make([]string, 0, len(setTagsRequest.Tags))
+	for _, name := range setTagsRequest.Tags {
+		name, err := normTagName(name)
+		if err != nil {
+			badRequest(logPrefix+"invalid tag name", err, w)
+			return
+		}
+		names = append(names, name)
+	}
+
+	owned, err := activityOwnedBy(actId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"check activity owner", err, w)
+		return
+	}
+	if !owned {
+		httpError(logPrefix+"activity not found", actId, http.StatusNotFound, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"setting tags of activity %d to %q", actId, names)
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM activity_tags WHERE activity_id=?;`, actId); err != nil {
+		internalError(logPrefix+"exec untag activity query", err, w)
+		return
+	}
+	for _, name := range names {
+		tagId, err := selectTag(tx, *user.Id, name)
+		if err != nil {
+			internalError(logPrefix+"select tag", err, w)
+			return
+		}
+		if tagId == 0 {
+			execRes, err := tx.Exec(`INSERT INTO tags (name, user_id) VALUES (?, ?);`, name, *user.Id)
+			if err != nil {
+				internalError(logPrefix+"exec insert new tag query", err, w)
+				return
+			}
+			if tagId, err = execRes.LastInsertId(); err != nil {
+				internalError(logPrefix+"get last insert id", err, w)
+				return
+			}
+			metricCreated.WithLabelValues("tag").Inc()
+		}
+		if _, err = tx.Exec(`INSERT OR IGNORE INTO activity_tags (activity_id, tag_id) VALUES (?, ?);`,
+			actId, tagId); err != nil {
+			internalError(logPrefix+"exec tag activity query", err, w)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// selectTag returns id of user's tag called name or 0 if there is no such tag
+func selectTag(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, uid uint, name string) (tagId int64, err error) {
+	err = q.QueryRow(`SELECT id FROM tags WHERE user_id=? AND name=?;`, uid, name).Scan(&tagId)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("select tag %q: %v", name, err)
+	}
+	return
+}
+
+// selectActivityTags returns names of tags for each tagged activity of user uid
+func selectActivityTags(uid uint) (tags map[int64][]string, err error) {
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT AT.activity_id, T.name
+FROM activity_tags AT JOIN tags T ON AT.tag_id = T.id
+WHERE T.user_id = ? ORDER BY T.name ASC;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select activity tags: %v", err)
+		return
+	}
+	defer rows.Close()
+	tags = make(map[int64][]string)
+	for rows.Next() {
+		var actId int64
+		var name string
+		if err = rows.Scan(&actId, &name); err != nil {
+			err = fmt.Errorf("scan next row: %v", err)
+			return
+		}
+		tags[actId] = append(tags[actId], name)
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// targetVersion is target of an activity in force starting from day since
+type targetVersion struct {
+	since time.Time
+	activityTarget
+}
+
+// targetHistory holds versions of an activity target ordered by the day they came into force
+type targetHistory []targetVersion
+
+// at returns target in force on day. Days before the first version use the first one as the activity
+// had no other target then.
+func (h targetHistory) at(day time.Time) activityTarget {
+	if len(h) == 0 {
+		return activityTarget{}
+	}
+	i := sort.Search(len(h), func(i int) bool { return h[i].since.After(day) })
+	if i == 0 {
+		return h[0].activityTarget
+	}
+	return h[i-1].activityTarget
+}
+
+// histTarget is what was planned for an activity during the days of week history
+type histTarget struct {
+	Days    [7]int `json:"days"`
+	PerWeek int    `json:"per_week,omitempty"`
+}
+
+func (h targetHistory) hist(weekStart time.Time) (ht histTarget) {
+	for i := range ht.Days {
+		day := weekStart.AddDate(0, 0, i)
+		ht.Days[i] = h.at(day).daily(day)
+	}
+	today := weekStart.AddDate(0, 0, len(ht.Days)-1)
+	ht.PerWeek, _ = h.at(today).weekly(today)
+	return
+}
+
+// saveTarget makes t the target of activity actId starting from today; an earlier change made today is
+// overwritten
+func saveTarget(q interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, actId int64, t activityTarget) error {
+	var days, activeFrom, activeUntil interface{}
+	perWeek := 0
+	if t.sched != nil {
+		if t.sched.Days != nil {
+			days = formatDays(*t.sched.Days)
+		}
+		perWeek = t.sched.PerWeek
+		if t.sched.ActiveFrom != 0 {
+			activeFrom = t.sched.ActiveFrom
+		}
+		if t.sched.ActiveUntil != 0 {
+			activeUntil = t.sched.ActiveUntil
+		}
+	}
+	_, err := q.Exec(`INSERT OR REPLACE INTO activity_targets
+(activity_id, effective_from, npom, days, per_week, active_from, active_until) VALUES (?, ?, ?, ?, ?, ?, ?);`,
+		actId, unixMs(dayBegin(time.Now())), t.npom, days, perWeek, activeFrom, activeUntil)
+	if err != nil {
+		return fmt.Errorf("insert activity target: %v", err)
+	}
+	return nil
+}
+
+// selectTargetsQuery selects all target versions of activities in a query joining activities A and
+// categories C; activities without versions get their npom
+const selectTargetsQuery = `SELECT A.id, IFNULL(T.effective_from, 0), IFNULL(T.npom, A.npom), T.days,
+IFNULL(T.per_week, 0), IFNULL(T.active_from, 0), IFNULL(T.active_until, 0)
+FROM activities A JOIN categories C ON A.category_id = C.id
+LEFT JOIN activity_targets T ON T.activity_id = A.id`
+
+func scanTargetVersion(rows *sql.Rows) (actId int64, v targetVersion, err error) {
+	var since int64
+	var days sql.NullString
+	var sched schedule
+	if err = rows.Scan(&actId, &since, &v.npom, &days, &sched.PerWeek, &sched.ActiveFrom,
+		&sched.ActiveUntil); err != nil {
+		err = fmt.Errorf("scan next row: %v", err)
+		return
+	}
+	v.since = msTime(since)
+	if days.Valid {
+		var d [7]int
+		if d, err = parseDays(days.String); err != nil {
+			return
+		}
+		sched.Days = &d
+	}
+	if sched != (schedule{}) {
+		v.sched = &sched
+	}
+	return
+}
+
+// selectTargetHistories returns target histories of activities of user uid matching filter
+func selectTargetHistories(uid uint, filter activityFilter) (targets map[int64]targetHistory, err error) {
+	where, args := filter.where(uid)
+	var rows *sql.Rows
+	rows, err = db.Query(selectTargetsQuery+` WHERE `+where+` ORDER BY A.id, T.effective_from;`, args...)
+	if err != nil {
+		err = fmt.Errorf("select activity targets: %v", err)
+		return
+	}
+	defer rows.Close()
+	targets = make(map[int64]targetHistory)
+	for rows.Next() {
+		var actId int64
+		var v targetVersion
+		if actId, v, err = scanTargetVersion(rows); err != nil {
+			return
+		}
+		targets[actId] = append(targets[actId], v)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("read activity target rows: %v", err)
+	}
+	return
+}
+
+// selectActivityTarget returns target of activity actId in force today; activity that doesn't exist has
+// nothing planned
+func selectActivityTarget(q interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, actId int64) (t activityTarget, err error) {
+	var rows *sql.Rows
+	rows, err = q.Query(selectTargetsQuery+` WHERE A.id = ? ORDER BY T.effective_from;`, actId)
+	if err != nil {
+		err = fmt.Errorf("select activity target: %v", err)
+		return
+	}
+	defer rows.Close()
+	var h targetHistory
+	for rows.Next() {
+		var v targetVersion
+		if _, v, err = scanTargetVersion(rows); err != nil {
+			return
+		}
+		h = append(h, v)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("read activity target rows: %v", err)
+		return
+	}
+	return h.at(time.Now()), nil
+}
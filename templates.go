@@ -0,0 +1,548 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Templates are snapshots of a category subtree with activities and their current targets (no history).
+// A template is private to its author until an admin publishes it to everyone on the instance, so that
+// a team can set up newcomers with the same routines. Templates made by admins are published right away.
+
+// templateVisibleCond matches templates user can see; args are user id and whether user is admin
+const templateVisibleCond = `(published OR created_by = ? OR ?)`
+
+type templateCategory struct {
+	Name       string             `json:"name"`
+	Activities []templateActivity `json:"activities"`
+	Children   []templateCategory `json:"children,omitempty"`
+}
+
+type templateActivity struct {
+	Name     string    `json:"name"`
+	Npom     int       `json:"npom"`
+	Schedule *schedule `json:"schedule,omitempty"`
+}
+
+func templatesListHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, name, created, IFNULL(created_by, 0), published FROM templates
+WHERE `+templateVisibleCond+` ORDER BY name ASC;`, *user.Id, user.role == roleAdmin)
+	if err != nil {
+		internalError(logPrefix+"select templates list", err, w)
+		return
+	}
+	defer rows.Close()
+
+	type templateInfo struct {
+		Id        int64  `json:"id"`
+		Name      string `json:"name"`
+		Created   int64  `json:"created"`
+		CreatedBy int64  `json:"created_by"`
+		Published bool   `json:"published"`
+	}
+	templates := []templateInfo{}
+	for rows.Next() {
+		var t templateInfo
+		var created time.Time
+		if err = rows.Scan(&t.Id, &t.Name, &created, &t.CreatedBy, &t.Published); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		t.Created = unixMs(created)
+		templates = append(templates, t)
+	}
+
+	respBody, err := json.Marshal(templates)
+	if err != nil {
+		internalError(logPrefix+"encode templates list", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func templateHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	tmplId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var resp struct {
+		Id       int64            `json:"id"`
+		Name     string           `json:"name"`
+		Category templateCategory `json:"category"`
+	}
+	resp.Id = tmplId
+	if resp.Name, resp.Category, err = selectTemplate(tmplId, user); err == sql.ErrNoRows {
+		httpError(logPrefix+"template not found", tmplId, http.StatusNotFound, w)
+		return
+	} else if err != nil {
+		internalError(logPrefix+"select template", err, w)
+		return
+	}
+
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		internalError(logPrefix+"encode template", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// newTemplateHandler saves user's category with subcategories and activities as a template; archived
+// ones are left out
+func newTemplateHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	var newTemplateRequest struct {
+		Name  string `json:"name"`
+		CatId int64  `json:"cat_id"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&newTemplateRequest); err != nil {
+		badRequest(logPrefix+"decode new template", err, w)
+		return
+	}
+	if len(newTemplateRequest.Name) == 0 {
+		badRequest(logPrefix+"empty template name", nil, w)
+		return
+	}
+
+	cat, found, err := snapshotCategory(*user.Id, newTemplateRequest.CatId)
+	if err != nil {
+		internalError(logPrefix+"snapshot category", err, w)
+		return
+	}
+	if !found {
+		httpError(logPrefix+"category not found", newTemplateRequest.CatId, http.StatusNotFound, w)
+		return
+	}
+	body, err := json.Marshal(cat)
+	if err != nil {
+		internalError(logPrefix+"encode template body", err, w)
+		return
+	}
+
+	execRes, err := db.Exec(`INSERT INTO templates (name, created, created_by, body, published)
+VALUES (?, ?, ?, ?, ?);`, newTemplateRequest.Name, time.Now().Unix()*1000, *user.Id, string(body),
+		user.role == roleAdmin)
+	if err != nil {
+		internalError(logPrefix+"exec insert new template query", err, w)
+		return
+	}
+	newId, err := execRes.LastInsertId()
+	if err != nil {
+		internalError(logPrefix+"get last insert id", err, w)
+		return
+	}
+	metricCreated.WithLabelValues("template").Inc()
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d}`, newId))
+}
+
+// removeTemplateHandler lets template be removed by its author or an admin
+func removeTemplateHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	tmplId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var createdBy int64
+	err = db.QueryRow(`SELECT IFNULL(created_by, 0) FROM templates WHERE id=? AND `+templateVisibleCond+`;`,
+		tmplId, *user.Id, user.role == roleAdmin).Scan(&createdBy)
+	if err == sql.ErrNoRows {
+		httpError(logPrefix+"template not found", tmplId, http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		internalError(logPrefix+"select template author", err, w)
+		return
+	}
+	if createdBy != int64(*user.Id) && user.role != roleAdmin {
+		forbidden(logPrefix+"only author or admin can remove template", tmplId, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"removing template %d", tmplId)
+
+	if _, err = db.Exec(`DELETE FROM templates WHERE id=?;`, tmplId); err != nil {
+		internalError(logPrefix+"exec remove template query", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func publishTemplateHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setTemplatePublished(user, w, r, logPrefix, true)
+}
+
+func unpublishTemplateHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	setTemplatePublished(user, w, r, logPrefix, false)
+}
+
+// setTemplatePublished makes template visible to everyone or back to its author only; admins only
+func setTemplatePublished(_ *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string, published bool) {
+	tmplId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"setting template %d published to %t", tmplId, published)
+
+	res, err := db.Exec(`UPDATE templates SET published=? WHERE id=?;`, published, tmplId)
+	if err != nil {
+		internalError(logPrefix+"exec publish template query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"template not found", tmplId, http.StatusNotFound, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// instantiateTemplateHandler creates categories and activities described by template for the user or,
+// if the caller is an admin, for user_id
+func instantiateTemplateHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	tmplId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var instantiateRequest struct {
+		UserId   int64  `json:"user_id"`
+		ParentId int64  `json:"parent_id"`
+		Name     string `json:"name"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&instantiateRequest); err != nil {
+		badRequest(logPrefix+"decode instantiate template request body", err, w)
+		return
+	}
+
+	uid := *user.Id
+	if instantiateRequest.UserId != 0 && instantiateRequest.UserId != int64(uid) {
+		if user.role != roleAdmin {
+			forbidden(logPrefix+"admin role required to instantiate template for another user", nil, w)
+			return
+		}
+		var found bool
+		if err = db.QueryRow(`SELECT count(*) > 0 FROM users WHERE id=?;`,
+			instantiateRequest.UserId).Scan(&found); err != nil {
+			internalError(logPrefix+"select user", err, w)
+			return
+		}
+		if !found {
+			httpError(logPrefix+"user not found", instantiateRequest.UserId, http.StatusNotFound, w)
+			return
+		}
+		uid = uint(instantiateRequest.UserId)
+	}
+	if instantiateRequest.ParentId != 0 {
+		owned, err := categoryOwnedBy(instantiateRequest.ParentId, uid)
+		if err != nil {
+			internalError(logPrefix+"check parent category owner", err, w)
+			return
+		}
+		if !owned {
+			httpError(logPrefix+"parent category not found", instantiateRequest.ParentId, http.StatusNotFound, w)
+			return
+		}
+	}
+
+	_, cat, err := selectTemplate(tmplId, user)
+	if err == sql.ErrNoRows {
+		httpError(logPrefix+"template not found", tmplId, http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		internalError(logPrefix+"select template", err, w)
+		return
+	}
+	if len(instantiateRequest.Name) != 0 {
+		cat.Name = instantiateRequest.Name
+	}
+
+	logD.Printf(logPrefix+"instantiating template %d for user %d", tmplId, uid)
+
+	newId, err := createCategoryFrom(logPrefix, uid, instantiateRequest.ParentId, cat)
+	if err != nil {
+		internalError(logPrefix+"create category from template", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d}`, newId))
+}
+
+// cloneCategoryHandler duplicates category with subcategories, activities and their targets next to it;
+// history is not copied
+func cloneCategoryHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	catId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	var cloneRequest struct {
+		Name string `json:"name"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&cloneRequest); err != nil {
+		badRequest(logPrefix+"decode clone category request body", err, w)
+		return
+	}
+
+	cat, found, err := snapshotCategory(*user.Id, catId)
+	if err != nil {
+		internalError(logPrefix+"snapshot category", err, w)
+		return
+	}
+	if !found {
+		httpError(logPrefix+"category not found", catId, http.StatusNotFound, w)
+		return
+	}
+	if len(cloneRequest.Name) != 0 {
+		cat.Name = cloneRequest.Name
+	}
+	var parentId int64
+	if err = db.QueryRow(`SELECT IFNULL(parent_id, 0) FROM categories WHERE id=?;`, catId).Scan(&parentId); err != nil {
+		internalError(logPrefix+"select parent category", err, w)
+		return
+	}
+
+	logD.Printf(logPrefix+"cloning category %d", catId)
+
+	newId, err := createCategoryFrom(logPrefix, *user.Id, parentId, cat)
+	if err != nil {
+		internalError(logPrefix+"create category copy", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d}`, newId))
+}
+
+// selectTemplate returns sql.ErrNoRows if there is no template tmplId user can see
+func selectTemplate(tmplId int64, user *userCtx) (name string, cat templateCategory, err error) {
+	var body string
+	if err = db.QueryRow(`SELECT name, body FROM templates WHERE id=? AND `+templateVisibleCond+`;`,
+		tmplId, *user.Id, user.role == roleAdmin).Scan(&name, &body); err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(body), &cat); err != nil {
+		err = fmt.Errorf("decode template body: %v", err)
+	}
+	return
+}
+
+// snapshotCategory describes user's category catId with its subtree as a template; archived categories
+// and activities are skipped
+func snapshotCategory(uid uint, catId int64) (cat templateCategory, found bool, err error) {
+	type catRow struct {
+		name     string
+		parentId int64
+	}
+	cats := make(map[int64]catRow)
+	var rows *sql.Rows
+	rows, err = db.Query(`SELECT id, name, IFNULL(parent_id, 0) FROM categories
+WHERE user_id=? AND archived IS NULL;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select categories: %v", err)
+		return
+	}
+	for rows.Next() {
+		var id int64
+		var c catRow
+		if err = rows.Scan(&id, &c.name, &c.parentId); err != nil {
+			rows.Close()
+			err = fmt.Errorf("scan next category: %v", err)
+			return
+		}
+		cats[id] = c
+	}
+	rows.Close()
+	if _, found = cats[catId]; !found {
+		return
+	}
+
+	targets, err := selectTargetHistories(uid, activityFilter{catId: catId, subcats: true})
+	if err != nil {
+		return
+	}
+	acts := make(map[int64][]templateActivity)
+	rows, err = db.Query(`SELECT A.id, A.category_id, A.name FROM activities A
+JOIN categories C ON A.category_id = C.id WHERE C.user_id=? AND A.archived IS NULL
+ORDER BY A.vorder ASC;`, uid)
+	if err != nil {
+		err = fmt.Errorf("select activities: %v", err)
+		return
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var actId, actCatId int64
+		var a templateActivity
+		if err = rows.Scan(&actId, &actCatId, &a.Name); err != nil {
+			err = fmt.Errorf("scan next activity: %v", err)
+			return
+		}
+		t := targets[actId].at(now)
+		a.Npom, a.Schedule = t.npom, t.sched
+		acts[actCatId] = append(acts[actCatId], a)
+	}
+
+	children := make(map[int64][]int64)
+	for id, c := range cats {
+		children[c.parentId] = append(children[c.parentId], id)
+	}
+	var build func(id int64, depth int) templateCategory
+	build = func(id int64, depth int) templateCategory {
+		tc := templateCategory{Name: cats[id].name, Activities: acts[id]}
+		if tc.Activities == nil {
+			tc.Activities = []templateActivity{}
+		}
+		// depth limit guards against cycles in a broken db
+		if depth < len(cats) {
+			ids := children[id]
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			for _, childId := range ids {
+				tc.Children = append(tc.Children, build(childId, depth+1))
+			}
+		}
+		return tc
+	}
+	cat = build(catId, 0)
+	return
+}
+
+// createCategoryFrom creates category for user uid under parentId (0 for root) with everything described
+// by cat and returns its id; created events are fired for every category and activity once all are in db
+func createCategoryFrom(logPrefix string, uid uint, parentId int64, cat templateCategory) (catId int64,
+	err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		err = fmt.Errorf("begin tx: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var numCats, numActs int
+	type createdEvent struct {
+		event string
+		data  map[string]interface{}
+	}
+	var events []createdEvent
+	var create func(parentId int64, cat templateCategory) (int64, error)
+	create = func(parentId int64, cat templateCategory) (int64, error) {
+		var parent interface{}
+		if parentId != 0 {
+			parent = parentId
+		}
+		res, err := tx.Exec(`INSERT INTO categories (name, user_id, parent_id) VALUES (?, ?, ?);`,
+			cat.Name, uid, parent)
+		if err != nil {
+			return 0, fmt.Errorf("insert category: %v", err)
+		}
+		catId, err := res.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("get last insert id: %v", err)
+		}
+		numCats++
+		events = append(events, createdEvent{eventCategoryCreated, map[string]interface{}{
+			"id": catId, "name": cat.Name, "parent_id": parentId}})
+
+		now := time.Now().Unix() * 1000
+		for _, a := range cat.Activities {
+			if a.Schedule != nil {
+				if err = a.Schedule.validate(); err != nil {
+					return 0, fmt.Errorf("activity %q: %v", a.Name, err)
+				}
+			}
+			res, err := tx.Exec(`INSERT INTO activities (name, npom, createtime, category_id, vorder)
+VALUES (?, ?, ?, ?, (SELECT IFNULL(max(vorder), 0) FROM activities) + 1);`, a.Name, a.Npom, now, catId)
+			if err != nil {
+				return 0, fmt.Errorf("insert activity: %v", err)
+			}
+			actId, err := res.LastInsertId()
+			if err != nil {
+				return 0, fmt.Errorf("get last insert id: %v", err)
+			}
+			if err = saveTarget(tx, actId, activityTarget{npom: a.Npom, sched: a.Schedule}); err != nil {
+				return 0, err
+			}
+			numActs++
+			events = append(events, createdEvent{eventActivityCreated, map[string]interface{}{
+				"id": actId, "cat_id": catId, "name": a.Name, "npom": a.Npom}})
+		}
+
+		for _, child := range cat.Children {
+			if _, err = create(catId, child); err != nil {
+				return 0, err
+			}
+		}
+		return catId, nil
+	}
+
+	if catId, err = create(parentId, cat); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		err = fmt.Errorf("commit tx: %v", err)
+		return
+	}
+	metricCreated.WithLabelValues("category").Add(float64(numCats))
+	metricCreated.WithLabelValues("activity").Add(float64(numActs))
+	for _, e := range events {
+		fireEvent(logPrefix, uid, e.event, e.data)
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often cert files are stat'ed for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader keeps the tls key pair loaded from disk and picks up renewed files without restart
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certPath)
+	if err != nil {
+		return fmt.Errorf("stat cert file: %v", err)
+	}
+	keyInfo, err := os.Stat(cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("stat key file: %v", err)
+	}
+	cr.checkedAt = time.Now()
+	if cr.cert != nil && certInfo.ModTime().Equal(cr.certMtime) && keyInfo.ModTime().Equal(cr.keyMtime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("load key pair: %v", err)
+	}
+	if cr.cert != nil {
+		logI.Printf("reloaded tls certificate from %s", cr.certPath)
+	}
+	cr.cert = &cert
+	cr.certMtime = certInfo.ModTime()
+	cr.keyMtime = keyInfo.ModTime()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checkedAt) > certCheckInterval {
+		// keep serving the old certificate if renewed files are half-written or broken
+		if err := cr.reload(); err != nil {
+			logE.Printf("reload tls certificate: %v", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+// withHSTS tells browsers to use https only for the next maxAge seconds
+func withHSTS(h http.Handler, maxAge int) http.Handler {
+	hdr := fmt.Sprintf("max-age=%d; includeSubDomains", maxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", hdr)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirectHandler sends plain http clients to the same url on the https port
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
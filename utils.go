@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -8,22 +9,33 @@ import (
 	"time"
 )
 
-func printRequest(r *http.Request) {
-	logD.Printf(">> [%s %s]", r.Method, r.URL.Path)
-	logD.Printf(">> %v", r)
-}
+// maxLoggedBody limits how much of a response body is kept for debug logging
+const maxLoggedBody = 4096
 
 type loggingResponseWriter struct {
 	http.ResponseWriter
-	response   string
+	body       bytes.Buffer
+	truncated  bool
 	statusCode int
 }
 
 func (lrw *loggingResponseWriter) Write(response []byte) (int, error) {
-	lrw.response = string(response)
+	if room := maxLoggedBody - lrw.body.Len(); room < len(response) {
+		lrw.body.Write(response[:room])
+		lrw.truncated = true
+	} else {
+		lrw.body.Write(response)
+	}
 	return lrw.ResponseWriter.Write(response)
 }
 
+func (lrw *loggingResponseWriter) loggedBody() string {
+	if lrw.truncated {
+		return lrw.body.String() + "...(truncated)"
+	}
+	return lrw.body.String()
+}
+
 func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
 	lrw.statusCode = statusCode
 	lrw.ResponseWriter.WriteHeader(statusCode)
@@ -35,8 +47,7 @@ func briefDescr(req *http.Request) string {
 
 func httpError(errMsg string, errData interface{}, status int, w http.ResponseWriter) {
 	errMsg = fmt.Sprintf("%s: %v", errMsg, errData)
-	logE.Println(errMsg)
-	logD.Printf("httpError: status: %d", status)
+	logE.Printf("%s (status: %d)", errMsg, status)
 	//w.WriteHeader(status)
 	http.Error(w, errMsg, status)
 }
@@ -61,6 +72,11 @@ func weekdays(today time.Time) (days [7]string) {
 	return
 }
 
+// unixMs converts t to milliseconds since epoch, the way timestamps are stored in db and sent to clients
+func unixMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 func parseIdFromPathTail(urlPath string) (catId int64, err error) {
 	parts := strings.Split(urlPath, "/")
 	if len(parts) < 2 {
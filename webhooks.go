@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhooks notify user's own services of tracking events. Every event is stored as a delivery per matching
+// webhook and sent by runWebhookWorker, so handlers never wait for remote hosts and failed deliveries are
+// retried with exponential backoff until they succeed or run out of attempts.
+
+const (
+	eventPomodoroLogged  = "pomodoro.logged"
+	eventTargetReached   = "target.reached"
+	eventCategoryCreated = "category.created"
+	eventCategoryDeleted = "category.deleted"
+	eventActivityCreated = "activity.created"
+	eventActivityDeleted = "activity.deleted"
+	eventReminderDue     = "reminder.due"
+)
+
+const (
+	webhookSignatureHeader = "X-Gtd-Signature"
+	webhookEventHeader     = "X-Gtd-Event"
+	webhookDeliveryHeader  = "X-Gtd-Delivery"
+)
+
+const (
+	webhookPollInterval = 30 * time.Second
+	webhookRetryBase    = 30 * time.Second
+	webhookRetryMax     = 6 * time.Hour
+	webhookLogRetention = 7 * 24 * time.Hour
+	// webhookBatch limits deliveries sent per db query and shown by webhookDeliveriesHandler
+	webhookBatch = 100
+	// webhookWorkers is how many webhooks are delivered to at once; deliveries of one webhook go in order
+	webhookWorkers = 8
+)
+
+var webhookEvents = []string{eventPomodoroLogged, eventTargetReached, eventCategoryCreated, eventCategoryDeleted,
+	eventActivityCreated, eventActivityDeleted, eventReminderDue}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookWake makes worker deliver new events right away instead of on the next poll
+var webhookWake = make(chan struct{}, 1)
+
+// webhookClient only connects to public addresses and networks allowed by config, so that webhooks can't be
+// used to reach services of gtd host or its intranet. Redirects are not followed for the same reason.
+var webhookClient = newWebhookClient(func() []*net.IPNet { return liveConf.webhookAllowedNets() })
+
+type webhook struct {
+	Id  int64  `json:"id"`
+	URL string `json:"url"`
+	// Events webhook is subscribed to; empty means all of them
+	Events  []string `json:"events"`
+	Created int64    `json:"created"`
+}
+
+func webhooksListHandler(user *userCtx, w http.ResponseWriter, _ *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, url, events, created FROM webhooks WHERE user_id=? ORDER BY id ASC;`, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"select webhooks", err, w)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []webhook{}
+	for rows.Next() {
+		var h webhook
+		var events string
+		var created time.Time
+		if err = rows.Scan(&h.Id, &h.URL, &events, &created); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		h.Events = parseEvents(events)
+		h.Created = unixMs(created)
+		hooks = append(hooks, h)
+	}
+
+	respBody, err := json.Marshal(hooks)
+	if err != nil {
+		internalError(logPrefix+"encode webhooks list", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+// newWebhookHandler registers webhook and responds with the secret its payloads are signed with; the
+// secret is not shown again
+func newWebhookHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	var newWebhookRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&newWebhookRequest); err != nil {
+		badRequest(logPrefix+"decode new webhook", err, w)
+		return
+	}
+	if err := validateWebhookURL(newWebhookRequest.URL); err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+	events, err := formatEvents(newWebhookRequest.Events)
+	if err != nil {
+		badRequest(logPrefix+"invalid events", err, w)
+		return
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		internalError(logPrefix+"generate webhook secret", err, w)
+		return
+	}
+	secret := hex.EncodeToString(b)
+
+	logD.Printf(logPrefix+"adding webhook %s", newWebhookRequest.URL)
+
+	execRes, err := db.Exec(`INSERT INTO webhooks (user_id, url, secret, events, created) VALUES (?, ?, ?, ?, ?);`,
+		*user.Id, newWebhookRequest.URL, secret, events, time.Now().Unix()*1000)
+	if err != nil {
+		internalError(logPrefix+"exec insert new webhook query", err, w)
+		return
+	}
+	newId, err := execRes.LastInsertId()
+	if err != nil {
+		internalError(logPrefix+"get last insert id", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, fmt.Sprintf(`{"id":%d,"secret":%q}`, newId, secret))
+}
+
+func removeWebhookHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	hookId, err := parseIdFromPathTail(r.URL.Path)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		internalError(logPrefix+"begin tx", err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM webhooks WHERE id=? AND user_id=?;`, hookId, *user.Id)
+	if err != nil {
+		internalError(logPrefix+"exec remove webhook query", err, w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		httpError(logPrefix+"webhook not found", hookId, http.StatusNotFound, w)
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id=?;`, hookId); err != nil {
+		internalError(logPrefix+"exec remove webhook deliveries query", err, w)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		internalError(logPrefix+"commit tx", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// webhookDeliveriesHandler responds with the latest deliveries of webhook, optionally only the ones with
+// given status
+func webhookDeliveriesHandler(user *userCtx, w http.ResponseWriter, r *http.Request, logPrefix string) {
+	if user.Id == nil {
+		forbidden(logPrefix+"user not found in db", nil, w)
+		return
+	}
+
+	hookId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		badRequest(logPrefix+"invalid url", err, w)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", deliveryPending, deliveryDelivered, deliveryFailed:
+	default:
+		badRequest(logPrefix+"unknown delivery status", status, w)
+		return
+	}
+
+	var found bool
+	if err = db.QueryRow(`SELECT count(*) > 0 FROM webhooks WHERE id=? AND user_id=?;`, hookId, *user.Id).
+		Scan(&found); err != nil {
+		internalError(logPrefix+"check webhook owner", err, w)
+		return
+	}
+	if !found {
+		httpError(logPrefix+"webhook not found", hookId, http.StatusNotFound, w)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, event, status, attempts, created, IFNULL(next_attempt, 0),
+IFNULL(delivered, 0), IFNULL(last_status, 0), IFNULL(last_error, '')
+FROM webhook_deliveries WHERE webhook_id=? AND (?='' OR status=?) ORDER BY id DESC LIMIT ?;`,
+		hookId, status, status, webhookBatch)
+	if err != nil {
+		internalError(logPrefix+"select webhook deliveries", err, w)
+		return
+	}
+	defer rows.Close()
+
+	type delivery struct {
+		Id          int64  `json:"id"`
+		Event       string `json:"event"`
+		Status      string `json:"status"`
+		Attempts    int    `json:"attempts"`
+		Created     int64  `json:"created"`
+		NextAttempt int64  `json:"next_attempt,omitempty"`
+		Delivered   int64  `json:"delivered,omitempty"`
+		// LastStatus is http status of the last attempt, 0 if no response was received
+		LastStatus int    `json:"last_status,omitempty"`
+		LastError  string `json:"last_error,omitempty"`
+	}
+	deliveries := []delivery{}
+	for rows.Next() {
+		var d delivery
+		var created time.Time
+		if err = rows.Scan(&d.Id, &d.Event, &d.Status, &d.Attempts, &created, &d.NextAttempt, &d.Delivered,
+			&d.LastStatus, &d.LastError); err != nil {
+			internalError(logPrefix+"read next row", err, w)
+			return
+		}
+		d.Created = unixMs(created)
+		deliveries = append(deliveries, d)
+	}
+
+	respBody, err := json.Marshal(deliveries)
+	if err != nil {
+		internalError(logPrefix+"encode webhook deliveries", err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(respBody))
+}
+
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("no host")
+	}
+	return nil
+}
+
+// formatEvents checks event names and encodes them the way they are stored in db
+func formatEvents(events []string) (string, error) {
+	for _, e := range events {
+		known := false
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return "", fmt.Errorf("unknown event %q", e)
+		}
+	}
+	return strings.Join(events, ","), nil
+}
+
+func parseEvents(s string) []string {
+	if len(s) == 0 {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// fireEvent queues event with data for every webhook of user uid subscribed to it. Failing to queue is
+// only logged as the action that caused the event has already succeeded.
+func fireEvent(logPrefix string, uid uint, event string, data interface{}) {
+	if err := queueEvent(uid, event, data); err != nil {
+		logE.Printf(logPrefix+"queue %s event: %v", event, err)
+		return
+	}
+	wakeWebhookWorker()
+}
+
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+func queueEvent(uid uint, event string, data interface{}) error {
+	rows, err := db.Query(`SELECT id, events FROM webhooks WHERE user_id=?;`, uid)
+	if err != nil {
+		return fmt.Errorf("select webhooks: %v", err)
+	}
+	var hookIds []int64
+	for rows.Next() {
+		var id int64
+		var events string
+		if err = rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan next row: %v", err)
+		}
+		subscribed := len(events) == 0
+		for _, e := range parseEvents(events) {
+			subscribed = subscribed || e == event
+		}
+		if subscribed {
+			hookIds = append(hookIds, id)
+		}
+	}
+	rows.Close()
+	if len(hookIds) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix() * 1000
+	payload, err := json.Marshal(struct {
+		Event   string      `json:"event"`
+		Created int64       `json:"created"`
+		Data    interface{} `json:"data"`
+	}{event, now, data})
+	if err != nil {
+		return fmt.Errorf("encode payload: %v", err)
+	}
+	for _, id := range hookIds {
+		if _, err = db.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, created, next_attempt)
+VALUES (?, ?, ?, ?, ?, ?);`, id, event, string(payload), deliveryPending, now, now); err != nil {
+			return fmt.Errorf("insert delivery: %v", err)
+		}
+	}
+	return nil
+}
+
+// runWebhookWorker delivers queued events until ctx is done
+func runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := deliverDueWebhooks(ctx); err != nil {
+			logE.Printf("deliver webhooks: %v", err)
+		}
+		if _, err := db.Exec(`DELETE FROM webhook_deliveries WHERE status<>? AND created<?;`, deliveryPending,
+			unixMs(time.Now().Add(-webhookLogRetention))); err != nil {
+			logE.Printf("remove old webhook deliveries: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+type pendingDelivery struct {
+	id       int64
+	hookId   int64
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverDueWebhooks makes an attempt for every pending delivery whose time has come. Webhooks are served
+// by a pool of workers, so a slow receiver holds up only its own deliveries.
+func deliverDueWebhooks(ctx context.Context) error {
+	for {
+		rows, err := db.Query(`SELECT D.id, D.webhook_id, D.event, D.payload, D.attempts, H.url, H.secret
+FROM webhook_deliveries D JOIN webhooks H ON D.webhook_id = H.id
+WHERE D.status=? AND D.next_attempt<=? ORDER BY D.id ASC LIMIT ?;`,
+			deliveryPending, unixMs(time.Now()), webhookBatch)
+		if err != nil {
+			return fmt.Errorf("select due deliveries: %v", err)
+		}
+		var due []pendingDelivery
+		for rows.Next() {
+			var d pendingDelivery
+			if err = rows.Scan(&d.id, &d.hookId, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan next row: %v", err)
+			}
+			due = append(due, d)
+		}
+		rows.Close()
+
+		var order []int64
+		byHook := make(map[int64][]pendingDelivery)
+		for _, d := range due {
+			if _, found := byHook[d.hookId]; !found {
+				order = append(order, d.hookId)
+			}
+			byHook[d.hookId] = append(byHook[d.hookId], d)
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, webhookWorkers)
+		errc := make(chan error, len(order))
+		for _, hookId := range order {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(deliveries []pendingDelivery) {
+				defer func() { <-sem; wg.Done() }()
+				for _, d := range deliveries {
+					if ctx.Err() != nil {
+						return
+					}
+					if err := attemptDelivery(ctx, d); err != nil {
+						errc <- err
+						return
+					}
+				}
+			}(byHook[hookId])
+		}
+		wg.Wait()
+		close(errc)
+		if err = <-errc; err != nil {
+			return err
+		}
+		if len(due) < webhookBatch || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// attemptDelivery posts payload of d and records the outcome; the error returned is about db only
+func attemptDelivery(ctx context.Context, d pendingDelivery) error {
+	params := liveConf.get().params
+	status, sendErr := postWebhook(ctx, webhookClient, d, time.Duration(params.WebhookTimeoutSec)*time.Second)
+	attempts := d.attempts + 1
+	now := time.Now()
+
+	if sendErr == nil {
+		metricWebhookDeliveries.WithLabelValues(deliveryDelivered).Inc()
+		_, err := db.Exec(`UPDATE webhook_deliveries SET status=?, attempts=?, delivered=?, next_attempt=NULL,
+last_status=?, last_error=NULL WHERE id=?;`, deliveryDelivered, attempts, unixMs(now), status, d.id)
+		if err != nil {
+			return fmt.Errorf("update delivery %d: %v", d.id, err)
+		}
+		return nil
+	}
+
+	logW.Printf("deliver webhook %d of %s event to %s (attempt %d): %v", d.id, d.event, d.url, attempts, sendErr)
+	newStatus, nextAttempt := failedAttemptOutcome(attempts, params.WebhookMaxAttempts, now)
+	if newStatus == deliveryFailed {
+		metricWebhookDeliveries.WithLabelValues(deliveryFailed).Inc()
+	} else {
+		metricWebhookDeliveries.WithLabelValues("retry").Inc()
+	}
+	_, err := db.Exec(`UPDATE webhook_deliveries SET status=?, attempts=?, next_attempt=?, last_status=NULLIF(?, 0),
+last_error=? WHERE id=?;`, newStatus, attempts, nextAttempt, status, sendErr.Error(), d.id)
+	if err != nil {
+		return fmt.Errorf("update delivery %d: %v", d.id, err)
+	}
+	return nil
+}
+
+// failedAttemptOutcome returns status of delivery after its attempt number attempts failed at now and, for
+// deliveries to be retried, the time of the next attempt in ms
+func failedAttemptOutcome(attempts, maxAttempts int, now time.Time) (status string, nextAttempt interface{}) {
+	if attempts >= maxAttempts {
+		return deliveryFailed, nil
+	}
+	return deliveryPending, unixMs(now.Add(retryDelay(attempts)))
+}
+
+// retryDelay doubles with every failed attempt up to webhookRetryMax
+func retryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return delay
+}
+
+// postWebhook sends payload of d signed with HMAC-SHA256 of webhook secret; any status but 2xx is an error
+func postWebhook(ctx context.Context, client *http.Client, d pendingDelivery, timeout time.Duration) (status int,
+	err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", d.url, bytes.NewBufferString(d.payload))
+	if err != nil {
+		return 0, fmt.Errorf("prepare request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.event)
+	req.Header.Set(webhookDeliveryHeader, fmt.Sprint(d.id))
+	req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(d.secret, d.payload))
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	// response body is never kept or shown, the receiver is not trusted
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func newWebhookClient(allowedNets func() []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// checking the address actually dialed also covers host names resolving to private addresses
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("unexpected address %s", address)
+			}
+			if !webhookAddrAllowed(ip, allowedNets()) {
+				return fmt.Errorf("address %s is not allowed for webhooks", ip)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func webhookAddrAllowed(ip net.IP, allowedNets []*net.IPNet) bool {
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || ip.IsMulticast())
+}
+
+func signPayload(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
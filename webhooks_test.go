@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func loopbackNets() []*net.IPNet {
+	nets, _ := parseNets([]string{"127.0.0.0/8", "::1/128"})
+	return nets
+}
+
+func TestPostWebhookSignsPayload(t *testing.T) {
+	d := pendingDelivery{id: 7, event: eventPomodoroLogged, payload: `{"event":"pomodoro.logged"}`, secret: "s3cret"}
+	var gotSig, gotEvent, gotDelivery, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+		gotSig = r.Header.Get(webhookSignatureHeader)
+		gotEvent = r.Header.Get(webhookEventHeader)
+		gotDelivery = r.Header.Get(webhookDeliveryHeader)
+	}))
+	defer srv.Close()
+	d.url = srv.URL
+
+	status, err := postWebhook(context.Background(), newWebhookClient(loopbackNets), d, time.Second)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("postWebhook = %d, %v; want 200, nil", status, err)
+	}
+	if gotBody != d.payload {
+		t.Errorf("body = %q, want %q", gotBody, d.payload)
+	}
+	mac := hmac.New(sha256.New, []byte(d.secret))
+	mac.Write([]byte(d.payload))
+	if wantSig := "sha256=" + hex.EncodeToString(mac.Sum(nil)); gotSig != wantSig {
+		t.Errorf("signature = %q, want %q", gotSig, wantSig)
+	}
+	if gotEvent != eventPomodoroLogged || gotDelivery != "7" {
+		t.Errorf("event, delivery headers = %q, %q", gotEvent, gotDelivery)
+	}
+}
+
+func TestPostWebhookStatuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		wantErr bool
+	}{
+		{"accepted", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusAccepted) }, 202, false},
+		{"server error", func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "internal details", http.StatusInternalServerError)
+		}, 500, true},
+		{"redirect", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+		}, 302, true},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.handler)
+		d := pendingDelivery{id: 1, event: eventCategoryCreated, payload: "{}", secret: "k", url: srv.URL}
+		status, err := postWebhook(context.Background(), newWebhookClient(loopbackNets), d, time.Second)
+		srv.Close()
+		if status != tt.status || (err != nil) != tt.wantErr {
+			t.Errorf("%s: postWebhook = %d, %v; want %d, error %v", tt.name, status, err, tt.status, tt.wantErr)
+		}
+		// response body must not leak into the delivery log
+		if err != nil && err.Error() != fmt.Sprintf("status %d", tt.status) {
+			t.Errorf("%s: error = %q, want status only", tt.name, err)
+		}
+	}
+}
+
+func TestPostWebhookRejectsLoopback(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+	defer srv.Close()
+
+	d := pendingDelivery{id: 1, event: eventCategoryCreated, payload: "{}", secret: "k", url: srv.URL}
+	noNets := func() []*net.IPNet { return nil }
+	if _, err := postWebhook(context.Background(), newWebhookClient(noNets), d, time.Second); err == nil || called {
+		t.Errorf("delivery to %s went through without webhook_allowed_nets", srv.URL)
+	}
+}
+
+func TestFailedAttemptOutcome(t *testing.T) {
+	now := time.Now()
+	status, next := failedAttemptOutcome(1, 3, now)
+	if status != deliveryPending || next != unixMs(now.Add(webhookRetryBase)) {
+		t.Errorf("first failure: %s, %v; want pending in %v", status, next, webhookRetryBase)
+	}
+	status, next = failedAttemptOutcome(3, 3, now)
+	if status != deliveryFailed || next != nil {
+		t.Errorf("last failure: %s, %v; want failed", status, next)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if d := retryDelay(1); d != webhookRetryBase {
+		t.Errorf("retryDelay(1) = %v, want %v", d, webhookRetryBase)
+	}
+	if d := retryDelay(3); d != 4*webhookRetryBase {
+		t.Errorf("retryDelay(3) = %v, want %v", d, 4*webhookRetryBase)
+	}
+	for _, attempts := range []int{20, 100, 1000} {
+		if d := retryDelay(attempts); d != webhookRetryMax {
+			t.Errorf("retryDelay(%d) = %v, want cap %v", attempts, d, webhookRetryMax)
+		}
+	}
+}